@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cumulodev/goutils/pool"
+	"github.com/cumulodev/hoster-tools/internal/agentconf"
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/exitcode"
+	"github.com/cumulodev/hoster-tools/internal/output"
+	"github.com/cumulodev/nimbusec"
+)
+
+// coverage states, in the order of the summary
+var states = []string{"ok", "missing", "never", "stale", "unregistered"}
+
+var fields = []string{
+	"domain", "status", "id", "bundleid", "configs", "docroot",
+	"agent", "token", "lastCall", "version",
+}
+
+const defaultFields = "domain,status,configs,agent,lastCall,version"
+
+// entry is a domain registered in the account, listed in an agent.conf or
+// both.
+type entry struct {
+	name     string
+	domain   *nimbusec.Domain         // nil if not registered
+	configs  []string                 // agent.conf files listing the domain
+	docroot  string                   // docroot of the first agent.conf
+	token    *nimbusec.Token          // token of the first agent.conf, nil if unknown
+	metadata *nimbusec.DomainMetadata // nil if not registered
+	status   string
+}
+
+func main() {
+	url := flag.String("url", nimbusec.DefaultAPI, "API Url")
+	key := flag.String("key", "abc", "API key for authentication")
+	secret := flag.String("secret", "abc", "API secret for authentication")
+	stale := flag.Duration("stale", 7*24*time.Hour, "report agents that did not report a domain for this long as stale")
+	all := flag.Bool("all", false, "list covered domains as well, not only problems")
+	workers := flag.Int("workers", 1, "number of parallel workers to fetch metadata (please do not use too many workers)")
+	configure := apiopts.Flags(flag.CommandLine)
+	outputFlags := output.Flags(flag.CommandLine, fields, defaultFields)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] agent.conf ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(exitcode.Usage)
+	}
+
+	writer, err := outputFlags(os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// creates a new nimbusec API instance
+	api, err := apiopts.NewAPI(*url, *key, *secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configure(api)
+
+	tokens, err := api.FindTokens(nimbusec.EmptyFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	byKey := make(map[string]*nimbusec.Token)
+	for i := range tokens {
+		byKey[tokens[i].Key] = &tokens[i]
+	}
+
+	entries := make(map[string]*entry)
+	get := func(name string) *entry {
+		e, ok := entries[name]
+		if !ok {
+			e = &entry{name: name}
+			entries[name] = e
+		}
+		return e
+	}
+
+	for _, path := range flag.Args() {
+		conf, err := agentconf.Read(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		token := byKey[conf.Key]
+		if token == nil {
+			log.Printf("%s: key %s is not an agent token of this account", path, conf.Key)
+		}
+
+		for name, docroot := range conf.Domains {
+			e := get(name)
+			if len(e.configs) == 0 {
+				e.docroot = docroot
+				e.token = token
+			}
+			e.configs = append(e.configs, path)
+		}
+	}
+
+	domains, err := api.FindDomains(nimbusec.EmptyFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pool := pool.New(*workers)
+	pool.Start()
+
+	for i := range domains {
+		e := get(domains[i].Name)
+		e.domain = &domains[i]
+		pool.Add(&metadataJob{api: api, entry: e})
+	}
+
+	pool.Wait()
+
+	now := time.Now()
+	names := []string{}
+	counts := make(map[string]int)
+	for name, e := range entries {
+		e.status = status(e, now.Add(-*stale))
+		counts[e.status]++
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		e := entries[name]
+		if e.status == "ok" && !*all {
+			continue
+		}
+		if err := writer.Write(record(e)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		log.Fatal(err)
+	}
+
+	summary := []string{}
+	for _, state := range states {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[state], state))
+	}
+	fmt.Fprintf(os.Stderr, "%d domains: %s\n", len(entries), strings.Join(summary, ", "))
+}
+
+// status returns the coverage of the domain:
+//
+//	ok:           listed in an agent.conf and reported since the deadline
+//	missing:      registered, but not listed in any agent.conf
+//	never:        listed, but no agent ever reported the domain
+//	stale:        listed, but not reported or the agent token not used since the deadline
+//	unregistered: listed in an agent.conf, but not registered in the account
+func status(e *entry, deadline time.Time) string {
+	lastCall := time.Time{}
+	if e.token != nil {
+		lastCall = output.Millis(e.token.LastCall)
+	}
+
+	switch {
+	case e.domain == nil:
+		return "unregistered"
+	case len(e.configs) == 0:
+		return "missing"
+	case !output.IsSet(e.metadata.Agent.Time):
+		return "never"
+	case e.metadata.Agent.Before(deadline):
+		return "stale"
+	case output.IsSet(lastCall) && lastCall.Before(deadline):
+		return "stale"
+	}
+	return "ok"
+}
+
+// record returns the field values of the entry.
+func record(e *entry) output.Record {
+	domain := e.domain
+	if domain == nil {
+		domain = new(nimbusec.Domain)
+	}
+	metadata := e.metadata
+	if metadata == nil {
+		metadata = new(nimbusec.DomainMetadata)
+	}
+	token := e.token
+	if token == nil {
+		token = new(nimbusec.Token)
+	}
+
+	return func(field string) interface{} {
+		switch field {
+		case "domain":
+			return e.name
+		case "status":
+			return e.status
+		case "id":
+			if domain.Id == 0 {
+				return nil
+			}
+			return domain.Id
+		case "bundleid":
+			return domain.Bundle
+		case "configs":
+			return strings.Join(e.configs, " ")
+		case "docroot":
+			return e.docroot
+		case "agent":
+			return metadata.Agent
+		case "token":
+			return token.Name
+		case "lastCall":
+			return output.Millis(token.LastCall)
+		case "version":
+			if token.Version == 0 {
+				return nil
+			}
+			return token.Version
+		}
+		return nil
+	}
+}
+
+// metadataJob fetches the metadata of a registered domain.
+type metadataJob struct {
+	api   *nimbusec.API
+	entry *entry
+
+	metadata *nimbusec.DomainMetadata
+	err      error
+}
+
+func (job *metadataJob) Work() {
+	job.metadata, job.err = job.api.GetDomainMetadata(job.entry.domain.Id)
+}
+
+func (job *metadataJob) Save() {
+	if job.err != nil {
+		log.Fatalf("metadata of %s: %v", job.entry.name, job.err)
+	}
+	job.entry.metadata = job.metadata
+}
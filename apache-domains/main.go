@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/cumulodev/hoster-tools/internal/apacheconf"
+	"github.com/cumulodev/hoster-tools/internal/importcsv"
+)
+
+func main() {
+	config := flag.String("config", "/etc/apache2/apache2.conf", "path to the Apache configuration file or a directory like sites-enabled")
+	aliases := flag.Bool("aliases", false, "export each ServerAlias of a virtual host as domain of its own")
+	bundle := flag.String("bundle", "", "bundle ID written for all domains")
+	flag.Parse()
+
+	vhosts, err := apacheconf.Parse(*config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	domains, skipped := apacheconf.Domains(vhosts, *aliases, *bundle)
+	for _, name := range skipped {
+		log.Printf("skipping wildcard name %s", name)
+	}
+
+	if err := importcsv.Validate(domains, importcsv.Options{}); err != nil {
+		log.Fatal(err)
+	}
+
+	writer := csv.NewWriter(os.Stdout)
+	for _, domain := range domains {
+		writer.Write([]string{domain.Name, domain.Path, domain.Scheme, domain.Bundle, ""})
+		writer.Flush()
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cumulodev/goutils/pool"
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/archive"
+	"github.com/cumulodev/hoster-tools/internal/exitcode"
+	"github.com/cumulodev/nimbusec"
+)
+
+func main() {
+	url := flag.String("url", nimbusec.DefaultAPI, "API Url")
+	key := flag.String("key", "abc", "API key for authentication")
+	secret := flag.String("secret", "abc", "API secret for authentication")
+	dir := flag.String("dir", "archive", "directory the archives are written to")
+	filter := flag.String("filter", nimbusec.EmptyFilter, "archive all domains matching this nimbusec filter expression")
+	workers := flag.Int("workers", 1, "number of parallel workers (please do not use too many workers)")
+	configure := apiopts.Flags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] [domain ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 && *filter == nimbusec.EmptyFilter {
+		flag.Usage()
+		os.Exit(exitcode.Usage)
+	}
+
+	// creates a new nimbusec API instance
+	api, err := apiopts.NewAPI(*url, *key, *secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configure(api)
+
+	archiver, err := archive.New(api, *dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	domains, err := api.FindDomains(*filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// domains given by name must all exist
+	if flag.NArg() > 0 {
+		byName := make(map[string]nimbusec.Domain)
+		for _, domain := range domains {
+			byName[domain.Name] = domain
+		}
+
+		domains = []nimbusec.Domain{}
+		for _, name := range flag.Args() {
+			domain, ok := byName[name]
+			if !ok {
+				log.Fatalf("domain %s not found", name)
+			}
+			domains = append(domains, domain)
+		}
+	}
+
+	pool := pool.New(*workers)
+	pool.Start()
+
+	failed := 0
+	for _, domain := range domains {
+		pool.Add(&archiveJob{
+			archiver: archiver,
+			domain:   domain,
+			failed:   &failed,
+		})
+	}
+
+	pool.Wait()
+
+	fmt.Printf("archived %d of %d domains\n", len(domains)-failed, len(domains))
+	if failed > 0 {
+		os.Exit(exitcode.Partial)
+	}
+}
+
+type archiveJob struct {
+	archiver *archive.Archiver
+	domain   nimbusec.Domain
+	failed   *int
+
+	path string
+	err  error
+}
+
+func (job *archiveJob) Work() {
+	job.path, job.err = job.archiver.Archive(job.domain)
+}
+
+func (job *archiveJob) Save() {
+	if job.err != nil {
+		*job.failed++
+		fmt.Printf("failed: %v\n", job.err)
+		return
+	}
+	fmt.Printf("archived: %s to %s\n", job.domain.Name, job.path)
+}
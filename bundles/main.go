@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/output"
+	"github.com/cumulodev/hoster-tools/internal/quota"
+	"github.com/cumulodev/nimbusec"
+)
+
+func main() {
+	url := flag.String("url", nimbusec.DefaultAPI, "url to nimbusec API")
+	key := flag.String("key", "", "nimbusec API key")
+	secret := flag.String("secret", "", "nimbusec API secret")
+	expiring := flag.Int("expiring", 30, "mark bundles ending within this number of days as expiring")
+	configure := apiopts.Flags(flag.CommandLine)
+	flag.Parse()
+
+	api, err := apiopts.NewAPI(*url, *key, *secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configure(api)
+
+	bundles, err := api.FindBundles(nimbusec.EmptyFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	now := time.Now()
+	soon := now.AddDate(0, 0, *expiring)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tNAME\tACTIVE\tCONTINGENT\tREMAINING\tUSAGE\tSTART\tEND\tSTATUS\n")
+	for _, usage := range quota.New(bundles, now).Usages() {
+		bundle := usage.Bundle
+
+		contingent, remaining, percent := "unlimited", "unlimited", "-"
+		if bundle.Contingent > 0 {
+			contingent = fmt.Sprint(bundle.Contingent)
+			remaining = fmt.Sprint(usage.Remaining())
+			percent = fmt.Sprintf("%.0f%%", 100*float64(bundle.Active)/float64(bundle.Contingent))
+		}
+
+		status := "ok"
+		switch {
+		case usage.Expired(now):
+			status = "expired"
+		case usage.Pending(now):
+			status = "pending"
+		case usage.Remaining() == 0:
+			status = "full"
+		case output.IsSet(bundle.End.Time) && bundle.End.Before(soon):
+			status = "expiring"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			bundle.Id, bundle.Name, bundle.Active, contingent, remaining, percent,
+			date(bundle.Start), date(bundle.End), status)
+	}
+	tw.Flush()
+}
+
+// date formats the timestamp as date, - if it is not set.
+func date(t nimbusec.Timestamp) string {
+	if !output.IsSet(t.Time) {
+		return "-"
+	}
+	return t.Format("2006-01-02")
+}
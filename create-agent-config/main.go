@@ -1,57 +1,45 @@
 package main
 
 import (
-	"encoding/csv"
-	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strings"
 
+	"github.com/cumulodev/hoster-tools/internal/agentconf"
+	"github.com/cumulodev/hoster-tools/internal/importcsv"
+	"github.com/cumulodev/hoster-tools/internal/nginxconf"
 	"github.com/cumulodev/nimbusec"
 )
 
-type AgentConfig struct {
-	Key           string            `json:"key"`
-	Secret        string            `json:"secret"`
-	Domains       map[string]string `json:"domains"`
-	TmpFile       string            `json:"tmpfile"`
-	ExcludeDir    []string          `json:"excludeDir"`
-	ExcludeRegexp []string          `json:"excludeRegexp"`
-	APIServer     string            `json:"apiserver"`
-}
-
 func main() {
 	api := flag.String("url", nimbusec.DefaultAPI, "API URL")
 	key := flag.String("key", "abc", "Agent Key")
 	secret := flag.String("secret", "abc", "Agent Secret")
 	filename := flag.String("file", "import.csv", "path to import file")
 	tmpfile := flag.String("tmpfile", "/tmp/nimbusec.tmp", "path of the tmpfile that writes interim results")
+	nginx := flag.String("nginx", "", "read the domains from this nginx configuration (e.g. /etc/nginx/nginx.conf) instead of the import file")
+	strict := flag.Bool("strict", false, "fail instead of skipping nginx server names that can not be mapped to a docroot")
 	flag.Parse()
 
-	file, err := os.Open(*filename)
-	if err != nil {
-		log.Fatal(err)
+	var rows []importcsv.Domain
+	var err error
+	if *nginx != "" {
+		rows, err = readNginx(*nginx, *strict)
+	} else {
+		rows, err = importcsv.ReadDomainsFile(*filename, importcsv.Options{Docroot: true})
 	}
-	defer file.Close()
-
-	reader := csv.NewReader(file)
-	rows, err := reader.ReadAll()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	docroots := make(map[string]string)
 	for _, row := range rows {
-		url := row[0]
-		docroot := row[1]
-
-		if url != "" {
-			docroots[url] = docroot
-		}
+		docroots[row.Name] = row.Path
 	}
 
-	conf := AgentConfig{
+	conf := agentconf.Config{
 		Key:           *key,
 		Secret:        *secret,
 		APIServer:     strings.TrimSuffix(*api, "/"),
@@ -61,11 +49,33 @@ func main() {
 		Domains:       docroots,
 	}
 
-	data, err := json.MarshalIndent(conf, "", "\t")
+	data, err := conf.Marshal()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	os.Stdout.Write(data)
-	os.Stdout.Write([]byte{'\n'})
+}
+
+// readNginx reads the domains and their docroots from the server blocks of an
+// nginx configuration. Server names that can not be mapped to a docroot are
+// skipped with a warning, or fail the run in strict mode.
+func readNginx(path string, strict bool) ([]importcsv.Domain, error) {
+	servers, err := nginxconf.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	domains, skipped := nginxconf.Domains(servers)
+	for _, skip := range skipped {
+		log.Printf("%s:%d: skipping server name %q: %s", skip.File, skip.Line, skip.Name, skip.Reason)
+	}
+	if strict && len(skipped) > 0 {
+		return nil, fmt.Errorf("%d server names can not be mapped to a docroot", len(skipped))
+	}
+
+	if err := importcsv.Validate(domains, importcsv.Options{Docroot: true}); err != nil {
+		return nil, err
+	}
+	return domains, nil
 }
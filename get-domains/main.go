@@ -1,36 +1,245 @@
 package main
 
 import (
-	"encoding/csv"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/cumulodev/goutils/pool"
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/exitcode"
+	"github.com/cumulodev/hoster-tools/internal/importcsv"
+	"github.com/cumulodev/hoster-tools/internal/output"
 	"github.com/cumulodev/nimbusec"
 )
 
+// fields of the domain records; the default fields are the fixed columns of
+// the import file of sync-domains, fastscan appends the landing pages
+var fields = []string{
+	importcsv.ColDomain, importcsv.ColPath, importcsv.ColScheme, importcsv.ColBundle, importcsv.ColDeeplink, importcsv.ColFastScan,
+	"id", "deepScan", "fastScans",
+	"bundleName", "lastDeepScan", "nextDeepScan", "lastFastScan", "nextFastScan", "agent", "files", "size",
+}
+
+// fields that require the metadata of each domain
+var metadataFields = map[string]bool{
+	"lastDeepScan": true,
+	"nextDeepScan": true,
+	"lastFastScan": true,
+	"nextFastScan": true,
+	"agent":        true,
+	"files":        true,
+	"size":         true,
+}
+
+const defaultFields = "domain,path,scheme,bundleid,deeplink"
+
 func main() {
 	url := flag.String("url", nimbusec.DefaultAPI, "url to nimbusec API")
 	key := flag.String("key", "", "nimbusec API key")
 	secret := flag.String("secret", "", "nimbusec API secret")
+	filter := flag.String("filter", nimbusec.EmptyFilter, "only list domains matching this nimbusec filter expression")
+	bundle := flag.String("bundle", "", "only list domains of this bundle ID")
+	scheme := flag.String("scheme", "", "only list domains with this scheme (http or https)")
+	workers := flag.Int("workers", 1, "number of parallel workers to fetch metadata and bundles (please do not use too many workers)")
+	configure := apiopts.Flags(flag.CommandLine)
+	outputFlags := output.Flags(flag.CommandLine, fields, defaultFields)
 	flag.Parse()
 
-	api, err := nimbusec.NewAPI(*url, *key, *secret)
+	writer, err := outputFlags(os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	api, err := apiopts.NewAPI(*url, *key, *secret)
 	if err != nil {
 		log.Fatal(err)
 	}
+	configure(api)
 
 	// find domains
-	var domains []nimbusec.Domain
-	domains, err = api.FindDomains(nimbusec.EmptyFilter)
+	domains, err := api.FindDomains(domainFilter(*filter, *bundle, *scheme))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	writer := csv.NewWriter(os.Stdout)
-	for _, domain := range domains {
-		writer.Write([]string{domain.Name, "", domain.Scheme, domain.Bundle, ""})
-		writer.Flush()
+	// only fetch what the selected fields need
+	needMetadata, needBundles := false, false
+	for _, field := range writer.Fields {
+		needMetadata = needMetadata || metadataFields[field]
+		needBundles = needBundles || field == "bundleName"
+	}
+
+	pool := pool.New(*workers)
+	pool.Start()
+
+	bundles := make(map[string]*nimbusec.Bundle)
+	bundleErrs := make(map[string]error)
+	if needBundles {
+		seen := make(map[string]bool)
+		for _, domain := range domains {
+			if !seen[domain.Bundle] {
+				seen[domain.Bundle] = true
+				pool.Add(&bundleJob{api: api, id: domain.Bundle, bundles: bundles, errs: bundleErrs})
+			}
+		}
+		pool.Wait()
+	}
+
+	metadata := make([]*nimbusec.DomainMetadata, len(domains))
+	metadataErrs := make([]error, len(domains))
+	if needMetadata {
+		for i, domain := range domains {
+			pool.Add(&metadataJob{api: api, domain: domain, dst: &metadata[i], dstErr: &metadataErrs[i]})
+		}
+		pool.Wait()
+	}
+
+	// written in the order of the API, not in the order the jobs finish; rows
+	// whose details could not be fetched are written with empty fields
+	failed := 0
+	for i, domain := range domains {
+		problems := []string{}
+		if err := bundleErrs[domain.Bundle]; err != nil {
+			problems = append(problems, fmt.Sprintf("bundle %s: %v", domain.Bundle, err))
+		}
+		if err := metadataErrs[i]; err != nil {
+			problems = append(problems, fmt.Sprintf("metadata: %v", err))
+		}
+		if len(problems) > 0 {
+			failed++
+			log.Printf("%s: %s", domain.Name, strings.Join(problems, "; "))
+		}
+
+		if err := writer.Write(record(domain, bundles[domain.Bundle], metadata[i])); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		log.Fatal(err)
+	}
+
+	if failed > 0 {
+		log.Printf("%d of %d domains are incomplete", failed, len(domains))
+		os.Exit(exitcode.Partial)
+	}
+}
+
+// domainFilter combines the filter expression with the bundle and scheme
+// selections, so the API only returns the selected domains.
+func domainFilter(filter, bundle, scheme string) string {
+	terms := []string{}
+	if filter != nimbusec.EmptyFilter {
+		terms = append(terms, filter)
+	}
+	if bundle != "" {
+		terms = append(terms, "bundle eq "+strconv.Quote(bundle))
+	}
+	if scheme != "" {
+		terms = append(terms, "scheme eq "+strconv.Quote(scheme))
+	}
+
+	if len(terms) > 1 && filter != nimbusec.EmptyFilter {
+		terms[0] = "(" + filter + ")"
+	}
+	return strings.Join(terms, " and ")
+}
+
+// record returns the field values of the domain. The bundle and metadata are
+// nil if no selected field needs them.
+func record(domain nimbusec.Domain, bundle *nimbusec.Bundle, metadata *nimbusec.DomainMetadata) output.Record {
+	row := importcsv.FromNimbusec(domain)
+	if bundle == nil {
+		bundle = new(nimbusec.Bundle)
+	}
+	if metadata == nil {
+		metadata = new(nimbusec.DomainMetadata)
+	}
+
+	return func(field string) interface{} {
+		switch field {
+		case importcsv.ColDomain:
+			return domain.Name
+		case importcsv.ColPath:
+			// the document root is not known to nimbusec
+			return ""
+		case importcsv.ColScheme:
+			return domain.Scheme
+		case importcsv.ColBundle:
+			return domain.Bundle
+		case importcsv.ColDeeplink:
+			return row.Deeplink
+		case importcsv.ColFastScan:
+			return row.FastScans
+		case "id":
+			return domain.Id
+		case "deepScan":
+			return domain.DeepScan
+		case "fastScans":
+			return domain.FastScans
+		case "bundleName":
+			return bundle.Name
+		case "lastDeepScan":
+			return metadata.LastDeepScan
+		case "nextDeepScan":
+			return metadata.NextDeepScan
+		case "lastFastScan":
+			return metadata.LastFastScan
+		case "nextFastScan":
+			return metadata.NextFastScan
+		case "agent":
+			return metadata.Agent
+		case "files":
+			return metadata.Files
+		case "size":
+			return metadata.Size
+		}
+		return nil
+	}
+}
+
+// bundleJob fetches a bundle to resolve its name.
+type bundleJob struct {
+	api     *nimbusec.API
+	id      string
+	bundles map[string]*nimbusec.Bundle // only written in Save
+	errs    map[string]error            // only written in Save
+
+	bundle *nimbusec.Bundle
+	err    error
+}
+
+func (job *bundleJob) Work() {
+	job.bundle, job.err = job.api.GetBundle(job.id)
+}
+
+func (job *bundleJob) Save() {
+	if job.err != nil {
+		job.errs[job.id] = job.err
+		return
 	}
+	job.bundles[job.id] = job.bundle
+}
+
+// metadataJob fetches the metadata of a domain.
+type metadataJob struct {
+	api    *nimbusec.API
+	domain nimbusec.Domain
+	dst    **nimbusec.DomainMetadata // only written in Save
+	dstErr *error                    // only written in Save
+
+	metadata *nimbusec.DomainMetadata
+	err      error
+}
+
+func (job *metadataJob) Work() {
+	job.metadata, job.err = job.api.GetDomainMetadata(job.domain.Id)
+}
 
+func (job *metadataJob) Save() {
+	*job.dst = job.metadata
+	*job.dstErr = job.err
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/nimbusec"
+)
+
+// fail-safe modes, see settings.failSafe
+const (
+	FailSafeKeep    = "keep"
+	FailSafeRecover = "recover"
+	FailSafeExit    = "exit"
+)
+
+// settings are the options of the trigger. They are read from the command
+// line and the optional config file and reloaded on SIGHUP.
+type settings struct {
+	filter    string
+	sleep     int
+	statePath string
+
+	action   string
+	recovery string
+	reload   string
+	onError  string
+	argv     bool // execute commands without a shell
+
+	hookTimeout time.Duration // kill hooks running longer, 0 for no limit
+	hookOutput  int           // bytes of output kept per hook
+	hookLog     string        // path to the JSON lines log of hook results, empty for none
+	workers     int           // number of domains handled in parallel
+
+	webhookURL        string
+	webhookMethod     string
+	webhookHeaders    headerList
+	webhookBody       string // template of the body, JSON of WebhookData if empty
+	webhookSecret     string // HMAC key signing the body
+	webhookRetries    int
+	webhookRetryDelay time.Duration
+	webhookTimeout    time.Duration
+	webhook           *webhook
+
+	errorDelay    time.Duration // delay before the first retry of a failed check
+	failSafe      string        // what to do if the API is unreachable for failSafeAfter
+	failSafeAfter time.Duration
+
+	url       string
+	key       string
+	secret    string
+	configure func(api *nimbusec.API)
+}
+
+// loadSettings parses the command line arguments. Options of the config file
+// given by -config apply unless they are set on the command line as well.
+func loadSettings(name string, args []string) (*settings, error) {
+	s := new(settings)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	config := fs.String("config", "", "path to a JSON file with options by flag name, re-read on SIGHUP (command line flags take precedence)")
+
+	fs.StringVar(&s.filter, "filter", "severity ge 3 and (event eq \"malware\" or event eq \"webshell\")", "filter for when a domain is considered infected")
+	fs.IntVar(&s.sleep, "sleep", 5, "sleep interval in minutes between checks")
+	fs.StringVar(&s.statePath, "state", "infected-domains-trigger.json", "path to the state file remembering the handled infected domains (empty to keep the state in memory only)")
+
+	fs.StringVar(&s.action, "action", "echo \">> infected: $DOMAIN\"", "execute command for each newly infected domain")
+	fs.StringVar(&s.recovery, "recover", "echo \">> recovered: $DOMAIN\"", "execute command for each domain that is no longer infected")
+	fs.StringVar(&s.reload, "reload", "echo \"reload trigger\"", "execute command after processing of infected and recovered domains (only called if there were any)")
+	fs.StringVar(&s.onError, "on-error", "", "execute command after each failed check, with FAILURES, FAILING_SINCE and ERROR set")
+	fs.DurationVar(&s.hookTimeout, "hook-timeout", 5*time.Minute, "kill a command with all its child processes if it runs longer (0 for no limit)")
+	fs.IntVar(&s.hookOutput, "hook-output", 4096, "number of bytes of the output of a command that are logged")
+	fs.StringVar(&s.hookLog, "hook-log", "", "append the exit code, duration and output of every command as JSON line to this file")
+	fs.IntVar(&s.workers, "workers", 1, "number of domains whose action or recover command and webhook run in parallel")
+	fs.BoolVar(&s.argv, "argv", false, "execute commands directly instead of by sh -c; the command is split at white space outside of quotes and $NAME is replaced by the hook variables")
+
+	fs.StringVar(&s.webhookURL, "webhook", "", "URL called for each newly infected and recovered domain (empty for none)")
+	fs.StringVar(&s.webhookMethod, "webhook-method", "POST", "HTTP method of the webhook")
+	fs.Var(&s.webhookHeaders, "webhook-header", "header of the webhook as \"Name: value\", may be repeated")
+	fs.StringVar(&s.webhookBody, "webhook-body", "", "Go template of the webhook body (default: the event as JSON)")
+	fs.StringVar(&s.webhookSecret, "webhook-secret", "", "sign the webhook body with HMAC-SHA256 using this secret, sent in the "+SignatureHeader+" header")
+	fs.IntVar(&s.webhookRetries, "webhook-retries", 3, "number of retries of a failed webhook call")
+	fs.DurationVar(&s.webhookRetryDelay, "webhook-retry-delay", time.Second, "delay before the first retry of a webhook call, doubled for every further retry")
+	fs.DurationVar(&s.webhookTimeout, "webhook-timeout", 30*time.Second, "timeout of a single webhook request")
+
+	fs.DurationVar(&s.errorDelay, "error-delay", 30*time.Second, "delay before retrying a failed check, doubled for every further failure up to the sleep interval")
+	fs.StringVar(&s.failSafe, "fail-safe", FailSafeKeep, "if the API is unreachable for fail-safe-after: keep the handled domains, recover them or exit")
+	fs.DurationVar(&s.failSafeAfter, "fail-safe-after", time.Hour, "time the API has to be unreachable before the fail-safe mode applies")
+
+	fs.StringVar(&s.url, "url", nimbusec.DefaultAPI, "url to nimbusec API")
+	fs.StringVar(&s.key, "key", "", "nimbusec API key")
+	fs.StringVar(&s.secret, "secret", "", "nimbusec API secret")
+	s.configure = apiopts.Flags(fs)
+
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil, err
+	} else if err != nil {
+		return nil, usageError{err}
+	}
+
+	if *config != "" {
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+
+		options, err := readConfig(*config)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range options {
+			if name == "config" {
+				return nil, fmt.Errorf("%s: option config is not allowed", *config)
+			}
+			if set[name] {
+				continue
+			}
+			for _, value := range values {
+				if err := fs.Set(name, value); err != nil {
+					return nil, fmt.Errorf("%s: option %s: %v", *config, name, err)
+				}
+			}
+		}
+	}
+
+	switch s.failSafe {
+	case FailSafeKeep, FailSafeRecover, FailSafeExit:
+	default:
+		return nil, fmt.Errorf("unknown fail-safe mode %q, expected keep, recover or exit", s.failSafe)
+	}
+
+	if s.workers < 1 {
+		return nil, fmt.Errorf("workers must be at least 1")
+	}
+	if s.errorDelay <= 0 {
+		return nil, fmt.Errorf("error-delay must be positive")
+	}
+
+	var err error
+	if s.webhook, err = newWebhook(s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// usageError is an invalid command line, which the flag set already reported
+// along with the usage.
+type usageError struct {
+	error
+}
+
+// readConfig reads a config file, a JSON object with the options by flag
+// name. Values may be strings, numbers or booleans; options that may be
+// repeated take a list of strings.
+func readConfig(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+
+	options := make(map[string][]string)
+	for name, value := range raw {
+		switch value := value.(type) {
+		case string, float64, bool:
+			options[name] = []string{fmt.Sprint(value)}
+		case []interface{}:
+			for _, item := range value {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: option %s must be a list of strings", path, name)
+				}
+				options[name] = append(options[name], s)
+			}
+		default:
+			return nil, fmt.Errorf("%s: option %s must be a string, number, boolean or list of strings", path, name)
+		}
+	}
+	return options, nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// hook kinds, as named in the log
+const (
+	HookAction  = "action"
+	HookRecover = "recover"
+	HookReload  = "reload"
+	HookOnError = "on-error"
+)
+
+// hook is a single execution of a command with its context.
+type hook struct {
+	kind    string // one of the Hook constants
+	domain  string // name of the domain, empty for reload and on-error
+	command string
+	vars    []string // NAME=value pairs passed to the command
+	stdin   []byte   // input of the command, nil for none
+}
+
+// HookResult is the outcome of a hook execution. It is logged and, if a hook
+// log is configured, appended to it as JSON line.
+type HookResult struct {
+	Time      time.Time `json:"time"`             // start of the execution
+	Hook      string    `json:"hook"`             // kind of the hook
+	Domain    string    `json:"domain,omitempty"` // domain the hook was executed for
+	Command   string    `json:"command"`
+	ExitCode  int       `json:"exitCode"`        // -1 if the command did not exit by itself
+	Duration  float64   `json:"duration"`        // in seconds
+	TimedOut  bool      `json:"timedOut"`        // killed after the timeout
+	Output    string    `json:"output"`          // stdout and stderr, truncated
+	Truncated int       `json:"truncated"`       // number of bytes dropped from the output
+	Error     string    `json:"error,omitempty"` // why the hook failed
+}
+
+// newInfection summarizes the results of a newly infected domain.
+func newInfection(domain nimbusec.Domain, results []nimbusec.Result) Infection {
+	infection := Infection{
+		Id:     domain.Id,
+		Scheme: domain.Scheme,
+		Bundle: domain.Bundle,
+	}
+
+	threats := make(map[string]bool)
+	for _, result := range results {
+		if result.Severity > infection.Severity {
+			infection.Severity = result.Severity
+		}
+		if result.Threatname != "" && !threats[result.Threatname] {
+			threats[result.Threatname] = true
+			infection.Threats = append(infection.Threats, result.Threatname)
+		}
+	}
+	sort.Strings(infection.Threats)
+
+	return infection
+}
+
+// vars returns the variables describing the infection of the named domain.
+func (i Infection) vars(name string) []string {
+	return []string{
+		"DOMAIN=" + name,
+		fmt.Sprintf("DOMAIN_ID=%d", i.Id),
+		"DOMAIN_SCHEME=" + i.Scheme,
+		"DOMAIN_BUNDLE=" + i.Bundle,
+		fmt.Sprintf("SEVERITY=%d", i.Severity),
+		"THREATS=" + strings.Join(i.Threats, ","),
+	}
+}
+
+// run executes the hook, an empty command does nothing. The command inherits
+// the environment of the trigger with the hook variables added. Its output is
+// captured and logged once it finished; it is killed with all its children
+// after the hook timeout. Hooks may run concurrently.
+//
+// By default the command is executed by sh -c. In argv mode the command is
+// split into words at white space outside of single or double quotes and
+// executed directly; $NAME and ${NAME} outside of single quotes are replaced
+// by the hook variables. A replaced value always stays within its argument
+// and is never interpreted by a shell.
+func (h hook) run(s *settings) error {
+	if h.command == "" {
+		return nil
+	}
+
+	result := HookResult{
+		Time:     time.Now(),
+		Hook:     h.kind,
+		Domain:   h.domain,
+		Command:  h.command,
+		ExitCode: -1,
+	}
+
+	err := h.exec(s, &result)
+	result.Duration = time.Since(result.Time).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	h.log(s, result)
+	return err
+}
+
+// exec executes the command and records its outcome.
+func (h hook) exec(s *settings, result *HookResult) error {
+	cmd, err := h.cmd(s.argv)
+	if err != nil {
+		return err
+	}
+
+	output := &limitedBuffer{max: s.hookOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = append(os.Environ(), h.vars...)
+	if h.stdin != nil {
+		cmd.Stdin = bytes.NewReader(h.stdin)
+	}
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if s.hookTimeout > 0 {
+		timer := time.NewTimer(s.hookTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	exited := true
+	select {
+	case err = <-done:
+	case <-timeout:
+		killProcessGroup(cmd)
+		result.TimedOut = true
+		err = fmt.Errorf("killed after timeout of %v", s.hookTimeout)
+
+		// a process outside of the group may still hold the output open,
+		// which blocks Wait; it is not waited for forever
+		select {
+		case <-done:
+		case <-time.After(killGrace):
+			exited = false
+			err = fmt.Errorf("killed after timeout of %v, output still open after %v", s.hookTimeout, killGrace)
+		}
+	}
+
+	// without Wait returning, the process state is not set and the output
+	// may still be written; later output is dropped
+	if exited {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	result.Output, result.Truncated = output.close()
+	return err
+}
+
+// cmd builds the command to execute.
+func (h hook) cmd(argv bool) (*exec.Cmd, error) {
+	if !argv {
+		return exec.Command("sh", "-c", h.command), nil
+	}
+
+	vars := make(map[string]string)
+	for _, v := range h.vars {
+		parts := strings.SplitN(v, "=", 2)
+		vars[parts[0]] = parts[1]
+	}
+
+	words, err := split(h.command, func(name string) string {
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return exec.Command(words[0], words[1:]...), nil
+}
+
+// split splits a command into words at white space. Single and double quotes
+// group white space into a word and are removed; variables are expanded by
+// mapping except within single quotes. There are no escapes.
+func split(command string, mapping func(string) string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		part    strings.Builder // text since the last quote
+		quote   rune
+		inWord  bool
+		literal bool // whether part is single-quoted
+	)
+
+	flush := func() {
+		if literal {
+			word.WriteString(part.String())
+		} else {
+			word.WriteString(os.Expand(part.String(), mapping))
+		}
+		part.Reset()
+	}
+
+	for _, r := range command {
+		switch {
+		case quote != 0 && r == quote:
+			flush()
+			quote, literal = 0, false
+		case quote != 0:
+			part.WriteRune(r)
+		case r == '\'' || r == '"':
+			flush()
+			quote, literal, inWord = r, r == '\'', true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				flush()
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			part.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		flush()
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// time to wait for the output of a killed hook to close
+const killGrace = 5 * time.Second
+
+// hookLogMu serializes writes to the hook log of concurrent hooks.
+var hookLogMu sync.Mutex
+
+// log reports the result of the hook and appends it to the hook log.
+func (h hook) log(s *settings, result HookResult) {
+	name := result.Hook
+	if result.Domain != "" {
+		name += " " + result.Domain
+	}
+
+	status := fmt.Sprintf("exit %d", result.ExitCode)
+	if result.Error != "" {
+		status = "error: " + result.Error
+	}
+
+	output := ""
+	if result.Output != "" {
+		output = "\n\t" + strings.Replace(strings.TrimRight(result.Output, "\n"), "\n", "\n\t", -1)
+	}
+	if result.Truncated > 0 {
+		output += fmt.Sprintf("\n\t... %d more bytes", result.Truncated)
+	}
+
+	log.Printf("hook %s: %s after %.3fs%s", name, status, result.Duration, output)
+
+	if s.hookLog == "" {
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("error: hook log: %v", err)
+		return
+	}
+
+	hookLogMu.Lock()
+	defer hookLogMu.Unlock()
+
+	f, err := os.OpenFile(s.hookLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("error: hook log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("error: hook log: %v", err)
+	}
+}
+
+// limitedBuffer keeps the first max bytes written to it and counts the rest.
+// Writes never fail, so a chatty command is not killed by a broken pipe.
+type limitedBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	max     int
+	dropped int
+	closed  bool // writes after close are discarded
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	if b.closed {
+		return n, nil
+	}
+	if free := b.max - b.buf.Len(); free < len(p) {
+		if free < 0 {
+			free = 0
+		}
+		b.dropped += len(p) - free
+		p = p[:free]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// close stops keeping the output and returns the kept output and the number
+// of dropped bytes.
+func (b *limitedBuffer) close() (string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return b.buf.String(), b.dropped
+}
@@ -0,0 +1,17 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing, process groups are not supported.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command. Its children keep running, as process
+// groups are not supported.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	vars := map[string]string{"DOMAIN": "example.com", "THREATS": "a b;rm -rf /"}
+	mapping := func(name string) string { return vars[name] }
+
+	tests := []struct {
+		command string
+		want    []string
+		err     bool
+	}{
+		{`echo ">> infected: $DOMAIN"`, []string{"echo", ">> infected: example.com"}, false},
+		{`notify  $DOMAIN	${THREATS}`, []string{"notify", "example.com", "a b;rm -rf /"}, false},
+		{`echo '$DOMAIN' x"$DOMAIN"y ''`, []string{"echo", "$DOMAIN", "xexample.comy", ""}, false},
+		{`echo "it's"`, []string{"echo", "it's"}, false},
+		{`echo "open`, nil, true},
+		{"  ", nil, false},
+	}
+
+	for _, test := range tests {
+		got, err := split(test.command, mapping)
+		if !reflect.DeepEqual(got, test.want) || (err != nil) != test.err {
+			t.Errorf("split(%q) = %q, %v; want %q", test.command, got, err, test.want)
+		}
+	}
+}
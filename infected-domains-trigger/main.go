@@ -1,62 +1,437 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/cumulodev/goutils/pool"
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/exitcode"
 	"github.com/cumulodev/nimbusec"
 )
 
 func main() {
-	filter := flag.String("filter", "severity ge 3 and (event eq \"malware\" or event eq \"webshell\")", "filter for when a domain is considered infected")
-	sleep := flag.Int("sleep", 5, "sleep interval in minutes between checks")
-
-	action := flag.String("action", "echo \">> infected: $DOMAIN\"", "execute command for each infected domain")
-	reload := flag.String("reload", "echo \"reload trigger\"", "execute command after processing of infected domains (only called if there were infected domains)")
+	s, err := loadSettings(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(exitcode.OK)
+	}
+	if err != nil {
+		// usage errors were already reported by the flag set
+		if _, ok := err.(usageError); !ok {
+			log.Print(err)
+		}
+		os.Exit(exitcode.Usage)
+	}
 
-	url := flag.String("url", nimbusec.DefaultAPI, "url to nimbusec API")
-	key := flag.String("key", "", "nimbusec API key")
-	secret := flag.String("secret", "", "nimbusec API secret")
-	flag.Parse()
+	api, err := newAPI(s)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	api, err := nimbusec.NewAPI(*url, *key, *secret)
+	state, err := readState(s.statePath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	t := &trigger{settings: s, api: api, state: state}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+
 	for {
-		// find infected domains
-		domains, err := api.FindInfected(*filter)
-		if err != nil {
-			log.Fatal(err)
+		delay := time.Duration(t.settings.sleep) * time.Minute
+		if err := t.check(); err != nil {
+			delay = t.failed(err)
+		} else {
+			t.succeeded()
+		}
+
+		// wait for the next check; a reload checks immediately with the new
+		// settings, a stop request ends the daemon between two checks
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case sig := <-signals:
+			timer.Stop()
+			if sig != syscall.SIGHUP {
+				log.Printf("received %s, exiting", sig)
+				return
+			}
+			t.reloadSettings()
 		}
+	}
+}
+
+// trigger checks the infected domains and executes the hooks.
+type trigger struct {
+	settings *settings
+	api      *nimbusec.API
+	state    *State
+
+	failures     int       // number of consecutive failed checks
+	failingSince time.Time // time of the first failed check
+	failedSafe   bool      // whether the fail-safe mode was applied
+
+	webhookFailures int // number of failed webhook calls since the start
+}
+
+// newAPI creates the API client for the settings.
+func newAPI(s *settings) (*nimbusec.API, error) {
+	api, err := apiopts.NewAPI(s.url, s.key, s.secret)
+	if err != nil {
+		return nil, err
+	}
+	s.configure(api)
+	return api, nil
+}
+
+// check fetches the infected domains and executes the hooks for all domains
+// that became infected or recovered since the last check.
+func (t *trigger) check() error {
+	// the retry budget of the API client applies per check
+	t.settings.configure(t.api)
+
+	// find infected domains
+	domains, err := t.api.FindInfected(t.settings.filter)
+	if err != nil {
+		return err
+	}
+
+	// the webhooks that failed at earlier checks are retried first, so the
+	// events of a domain arrive in order
+	t.retryWebhooks()
+
+	infected, recovered := t.state.Diff(domains)
+
+	// execute reload hook if the action or recover hook succeeded for at
+	// least one domain
+	if t.handle(infected, recovered) > 0 {
+		t.run(hook{kind: HookReload, command: t.settings.reload})
+	}
+
+	t.save()
+	return nil
+}
+
+// handle executes the action hook and webhook for each newly infected domain
+// and the recover hook and webhook for each recovered domain, using up to
+// workers domains in parallel. A domain whose hook failed keeps its state and
+// is thus handled again at the next check; a failed webhook is only marked as
+// pending. It returns the number of domains whose hook succeeded.
+func (t *trigger) handle(infected []nimbusec.Domain, recovered []string) int {
+	// all jobs are created before the first one is saved, as saving changes
+	// the state
+	jobs := []pool.Job{}
+	for _, domain := range infected {
+		jobs = append(jobs, &infectedJob{trigger: t, domain: domain})
+	}
+	for _, name := range recovered {
+		jobs = append(jobs, &recoverJob{trigger: t, name: name, infection: t.state.Domains[name]})
+	}
 
-		// execute action hook for each infected domain
-		for _, domain := range domains {
-			run(*action, domain.Name)
+	t.work(jobs)
+
+	succeeded := 0
+	for _, job := range jobs {
+		switch job := job.(type) {
+		case *infectedJob:
+			if job.err == nil {
+				succeeded++
+			}
+		case *recoverJob:
+			if job.err == nil {
+				succeeded++
+			}
 		}
+	}
+	return succeeded
+}
 
-		// execute reload hook if the filter matched something
-		if len(domains) > 0 {
-			run(*reload, "")
+// retryWebhooks sends the webhooks that failed at earlier checks again, using
+// up to workers domains in parallel. The hooks are not executed again.
+func (t *trigger) retryWebhooks() {
+	jobs := []pool.Job{}
+	for _, name := range sortedNames(t.state.Domains) {
+		if infection := t.state.Domains[name]; infection.WebhookPending {
+			jobs = append(jobs, &webhookJob{trigger: t, event: EventInfected, name: name, infection: infection})
 		}
+	}
+	for _, name := range sortedNames(t.state.Recovered) {
+		jobs = append(jobs, &webhookJob{trigger: t, event: EventRecovered, name: name, infection: t.state.Recovered[name]})
+	}
+
+	t.work(jobs)
+}
+
+// work runs the jobs using up to workers jobs in parallel.
+func (t *trigger) work(jobs []pool.Job) {
+	if len(jobs) == 0 {
+		return
+	}
 
-		time.Sleep(time.Duration(*sleep) * time.Minute)
+	pool := pool.New(t.settings.workers)
+	pool.Start()
+	for _, job := range jobs {
+		pool.Add(job)
 	}
+	pool.Wait()
+	pool.Stop()
 }
 
-func run(name string, domain string) {
-	cmd := exec.Command("sh", "-c", name)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = []string{"DOMAIN=" + domain}
+// infectedJob executes the action hook and webhook of a newly infected domain
+// with the results matching the filter.
+type infectedJob struct {
+	trigger *trigger
+	domain  nimbusec.Domain
+
+	data       []byte // results as JSON
+	infection  Infection
+	err        error
+	webhookErr error
+}
 
-	err := cmd.Run()
+func (job *infectedJob) Work() {
+	t := job.trigger
+	results, err := t.api.FindResults(job.domain.Id, t.settings.filter)
+	if err == nil {
+		job.data, err = json.Marshal(results)
+	}
 	if err != nil {
-		log.Printf("error: %v\n", err)
+		job.err = err
+		log.Printf("error: results of %s: %v", job.domain.Name, err)
+		return
+	}
+
+	job.infection = newInfection(job.domain, results)
+	vars := job.infection.vars(job.domain.Name)
+	if job.err = t.run(hook{HookAction, job.domain.Name, t.settings.action, vars, job.data}); job.err != nil {
+		return
+	}
+
+	job.webhookErr = t.send(EventInfected, job.domain, job.infection, results)
+}
+
+func (job *infectedJob) Save() {
+	t := job.trigger
+	if job.err != nil {
+		return
+	}
+	if job.webhookErr != nil {
+		t.webhookFailed(EventInfected, job.domain.Name, job.webhookErr)
+	}
+
+	job.infection.Since = time.Now()
+	job.infection.WebhookPending = job.webhookErr != nil
+	t.state.Domains[job.domain.Name] = job.infection
+
+	// a recovered webhook still failing is outdated by the new infection
+	delete(t.state.Recovered, job.domain.Name)
+}
+
+// recoverJob executes the recover hook and webhook of a handled domain that is
+// no longer infected.
+type recoverJob struct {
+	trigger   *trigger
+	name      string
+	infection Infection
+
+	err        error
+	webhookErr error
+}
+
+func (job *recoverJob) Work() {
+	t := job.trigger
+	vars := job.infection.vars(job.name)
+	if job.err = t.run(hook{HookRecover, job.name, t.settings.recovery, vars, nil}); job.err != nil {
+		return
 	}
+
+	job.webhookErr = t.send(EventRecovered, job.infection.domain(job.name), job.infection, nil)
+}
+
+func (job *recoverJob) Save() {
+	t := job.trigger
+	if job.err != nil {
+		return
+	}
+
+	delete(t.state.Domains, job.name)
+
+	// an infected webhook still failing is dropped, the recovered webhook
+	// replaces it
+	if job.webhookErr != nil {
+		t.webhookFailed(EventRecovered, job.name, job.webhookErr)
+		job.infection.WebhookPending = false
+		t.state.Recovered[job.name] = job.infection
+	}
+}
+
+// webhookJob sends a webhook that failed at an earlier check again.
+type webhookJob struct {
+	trigger   *trigger
+	event     string
+	name      string
+	infection Infection
+
+	err error
+}
+
+func (job *webhookJob) Work() {
+	t := job.trigger
+
+	// the results are not kept in the state, so the current ones are sent
+	var results []nimbusec.Result
+	if job.event == EventInfected {
+		if results, job.err = t.api.FindResults(job.infection.Id, t.settings.filter); job.err != nil {
+			return
+		}
+	}
+
+	job.err = t.send(job.event, job.infection.domain(job.name), job.infection, results)
+}
+
+func (job *webhookJob) Save() {
+	t := job.trigger
+	if job.err != nil {
+		t.webhookFailed(job.event, job.name, job.err)
+		return
+	}
+
+	switch job.event {
+	case EventInfected:
+		if infection, ok := t.state.Domains[job.name]; ok {
+			infection.WebhookPending = false
+			t.state.Domains[job.name] = infection
+		}
+	case EventRecovered:
+		delete(t.state.Recovered, job.name)
+	}
+}
+
+// send calls the webhook, if any, for the event of the domain.
+func (t *trigger) send(event string, domain nimbusec.Domain, infection Infection, results []nimbusec.Result) error {
+	threats := infection.Threats
+	if threats == nil {
+		threats = []string{}
+	}
+	if results == nil {
+		results = []nimbusec.Result{}
+	}
+
+	return t.settings.webhook.Send(WebhookData{
+		Event:    event,
+		Time:     time.Now(),
+		Domain:   domain,
+		Severity: infection.Severity,
+		Threats:  threats,
+		Results:  results,
+	})
+}
+
+// webhookFailed counts and reports a failed webhook call.
+func (t *trigger) webhookFailed(event, name string, err error) {
+	t.webhookFailures++
+	log.Printf("error: %s webhook of %s failed (%d failed calls so far), retrying at the next check: %v", event, name, t.webhookFailures, err)
+}
+
+// save writes the state file. If that fails, the state is kept in memory and
+// written again after the next check.
+func (t *trigger) save() {
+	t.state.Updated = time.Now()
+	if err := writeState(t.settings.statePath, t.state); err != nil {
+		log.Printf("error: state not saved, retrying after the next check: %v", err)
+	}
+}
+
+// failed handles a failed check and returns the delay until the next one.
+func (t *trigger) failed(err error) time.Duration {
+	now := time.Now()
+	if t.failures == 0 {
+		t.failingSince = now
+	}
+	t.failures++
+	log.Printf("error: check failed (%d in a row since %s): %v", t.failures, t.failingSince.Format(time.RFC3339), err)
+
+	if t.settings.onError != "" {
+		t.run(hook{kind: HookOnError, command: t.settings.onError, vars: []string{
+			fmt.Sprintf("FAILURES=%d", t.failures),
+			"FAILING_SINCE=" + t.failingSince.Format(time.RFC3339),
+			"ERROR=" + err.Error(),
+		}})
+	}
+
+	if !t.failedSafe && now.Sub(t.failingSince) >= t.settings.failSafeAfter {
+		t.failedSafe = true
+		t.failSafe()
+	}
+
+	// back off, but check at least as often as without errors
+	interval := time.Duration(t.settings.sleep) * time.Minute
+	delay := t.settings.errorDelay
+	for i := 1; i < t.failures && delay < interval; i++ {
+		delay *= 2
+	}
+	if delay > interval {
+		delay = interval
+	}
+	return delay
+}
+
+// failSafe applies the fail-safe mode once the API is unreachable for too
+// long.
+func (t *trigger) failSafe() {
+	switch t.settings.failSafe {
+	case FailSafeKeep:
+		log.Printf("API unreachable since %s, keeping %d handled domains", t.failingSince.Format(time.RFC3339), len(t.state.Domains))
+
+	case FailSafeRecover:
+		log.Printf("API unreachable since %s, recovering %d handled domains", t.failingSince.Format(time.RFC3339), len(t.state.Domains))
+		if t.handle(nil, sortedNames(t.state.Domains)) > 0 {
+			t.run(hook{kind: HookReload, command: t.settings.reload})
+		}
+		t.save()
+
+	case FailSafeExit:
+		log.Fatalf("API unreachable since %s, exiting", t.failingSince.Format(time.RFC3339))
+	}
+}
+
+// succeeded resets the failure count after a successful check.
+func (t *trigger) succeeded() {
+	if t.failures > 0 {
+		log.Printf("check succeeded again after %d failures", t.failures)
+	}
+	t.failures = 0
+	t.failedSafe = false
+}
+
+// reloadSettings re-reads the command line and config file. Invalid settings
+// are reported and the current ones are kept.
+func (t *trigger) reloadSettings() {
+	s, err := loadSettings(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Printf("error: reload: %v, keeping the current settings", err)
+		return
+	}
+
+	api, err := newAPI(s)
+	if err != nil {
+		log.Printf("error: reload: %v, keeping the current settings", err)
+		return
+	}
+
+	t.settings = s
+	t.api = api
+	log.Printf("reloaded settings")
+}
+
+// run executes the hook as configured.
+func (t *trigger) run(h hook) error {
+	return h.run(t.settings)
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// State remembers the domains the action was run for, so the action only runs
+// when a domain becomes infected and the recover hook when it is clean again.
+type State struct {
+	Updated   time.Time            `json:"updated"`             // end of the last check
+	Domains   map[string]Infection `json:"domains"`             // handled infected domains by name
+	Recovered map[string]Infection `json:"recovered,omitempty"` // recovered domains whose webhook failed, by name
+}
+
+// Infection is a domain the action was run for. The recover hook gets the
+// same details as the action. A failed webhook is remembered and retried at
+// the next checks without running the hooks again.
+type Infection struct {
+	Id       int       `json:"id"`       // ID of the domain
+	Scheme   string    `json:"scheme"`   // scheme of the domain
+	Bundle   string    `json:"bundle"`   // bundle ID of the domain
+	Severity int       `json:"severity"` // highest severity of the matching results
+	Threats  []string  `json:"threats"`  // distinct threat names of the matching results
+	Since    time.Time `json:"since"`    // time the action was run
+
+	WebhookPending bool `json:"webhookPending,omitempty"` // whether the infected webhook failed
+}
+
+// domain returns the details of the named domain known from the infection.
+func (i Infection) domain(name string) nimbusec.Domain {
+	return nimbusec.Domain{
+		Id:     i.Id,
+		Name:   name,
+		Scheme: i.Scheme,
+		Bundle: i.Bundle,
+	}
+}
+
+// NewState creates an empty state.
+func NewState() *State {
+	return &State{
+		Domains:   make(map[string]Infection),
+		Recovered: make(map[string]Infection),
+	}
+}
+
+// Diff compares the state with the currently infected domains. It returns the
+// domains that are newly infected and the names of the handled domains that
+// are no longer infected, both sorted by name.
+func (s *State) Diff(infected []nimbusec.Domain) ([]nimbusec.Domain, []string) {
+	current := make(map[string]bool)
+	added := []nimbusec.Domain{}
+	for _, domain := range infected {
+		current[domain.Name] = true
+		if _, ok := s.Domains[domain.Name]; !ok {
+			added = append(added, domain)
+		}
+	}
+
+	recovered := []string{}
+	for name := range s.Domains {
+		if !current[name] {
+			recovered = append(recovered, name)
+		}
+	}
+
+	sort.Slice(added, func(i, j int) bool { return added[i].Name < added[j].Name })
+	sort.Strings(recovered)
+	return added, recovered
+}
+
+// sortedNames returns the names of the domains sorted.
+func sortedNames(domains map[string]Infection) []string {
+	names := make([]string, 0, len(domains))
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readState loads the state file. A missing file or an empty path yields an
+// empty state.
+func readState(path string) (*State, error) {
+	if path == "" {
+		return NewState(), nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewState(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := NewState()
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state %s: %v", path, err)
+	}
+	if state.Domains == nil {
+		state.Domains = make(map[string]Infection)
+	}
+	if state.Recovered == nil {
+		state.Recovered = make(map[string]Infection)
+	}
+
+	return state, nil
+}
+
+// writeState stores the state at the given path, unless the path is empty.
+// The file is replaced atomically, so a crash never leaves a truncated state
+// behind.
+func writeState(path string, state *State) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".trigger-state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of the request body if the webhook
+// has a secret.
+const SignatureHeader = "X-Signature"
+
+// webhook events
+const (
+	EventInfected  = "infected"
+	EventRecovered = "recovered"
+)
+
+// WebhookData is passed to the body template of the webhook. Without a
+// template, it is sent as JSON.
+type WebhookData struct {
+	Event    string            `json:"event"`    // infected or recovered
+	Time     time.Time         `json:"time"`     // time of the event
+	Domain   nimbusec.Domain   `json:"domain"`   // the domain; of recovered domains only ID, name, scheme and bundle are known
+	Severity int               `json:"severity"` // highest severity of the matching results
+	Threats  []string          `json:"threats"`  // distinct threat names of the matching results
+	Results  []nimbusec.Result `json:"results"`  // results matching the filter, empty for recovered domains
+}
+
+// webhook sends the events of the trigger to an HTTP endpoint. A nil webhook
+// sends nothing.
+type webhook struct {
+	url     string
+	method  string
+	headers http.Header
+	body    *template.Template
+	secret  []byte
+	retries int
+	delay   time.Duration // delay before the first retry, doubled for every further retry
+	client  *http.Client
+}
+
+// headerList is a flag accepting a "Name: value" header, repeatable.
+type headerList []string
+
+func (l *headerList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *headerList) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("invalid header %q, expected Name: value", value)
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// newWebhook creates the webhook of the settings. It returns nil if no URL is
+// set.
+func newWebhook(s *settings) (*webhook, error) {
+	if s.webhookURL == "" {
+		return nil, nil
+	}
+
+	w := &webhook{
+		url:     s.webhookURL,
+		method:  strings.ToUpper(s.webhookMethod),
+		headers: make(http.Header),
+		secret:  []byte(s.webhookSecret),
+		retries: s.webhookRetries,
+		delay:   s.webhookRetryDelay,
+		client:  &http.Client{Timeout: s.webhookTimeout},
+	}
+
+	for _, header := range s.webhookHeaders {
+		parts := strings.SplitN(header, ":", 2)
+		w.headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if w.headers.Get("Content-Type") == "" {
+		w.headers.Set("Content-Type", "application/json")
+	}
+
+	if s.webhookBody != "" {
+		body, err := template.New("webhook").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+		}).Parse(s.webhookBody)
+		if err != nil {
+			return nil, fmt.Errorf("webhook body: %v", err)
+		}
+		w.body = body
+	}
+
+	return w, nil
+}
+
+// Send delivers the event. Network errors, 408, 429 and 5xx responses are
+// retried; every other response that is not 2xx fails immediately.
+func (w *webhook) Send(data WebhookData) error {
+	if w == nil {
+		return nil
+	}
+
+	var body bytes.Buffer
+	if w.body != nil {
+		if err := w.body.Execute(&body, data); err != nil {
+			return fmt.Errorf("webhook body: %v", err)
+		}
+	} else if err := json.NewEncoder(&body).Encode(data); err != nil {
+		return err
+	}
+
+	delay := w.delay
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body.Bytes())
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.retries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends a single request and reports whether a failure is worth a retry.
+func (w *webhook) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(w.method, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range w.headers {
+		req.Header[name] = values
+	}
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	// read a bit of the answer for the error message, the rest is discarded
+	// so the connection can be reused
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook %s %s: %s: %s", w.method, w.url, resp.Status, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+const testSecret = "s3cret"
+
+// request is a webhook call as received by the test server.
+type request struct {
+	method    string
+	header    http.Header
+	body      []byte
+	signature string // expected signature of the body
+}
+
+// recorder keeps the requests received by the test server.
+type recorder struct {
+	mu       sync.Mutex
+	requests []request
+}
+
+func (rec *recorder) get() []request {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.requests
+}
+
+// newTestWebhook starts a server answering with status and returns a webhook
+// posting to it together with the recorder of the received requests.
+func newTestWebhook(t *testing.T, status int, s settings) (*webhook, *recorder) {
+	rec := &recorder{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(testSecret))
+		mac.Write(body)
+
+		rec.mu.Lock()
+		rec.requests = append(rec.requests, request{r.Method, r.Header, body, "sha256=" + hex.EncodeToString(mac.Sum(nil))})
+		rec.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	s.webhookURL = server.URL
+	if s.webhookMethod == "" {
+		s.webhookMethod = "POST"
+	}
+	if s.webhookTimeout == 0 {
+		s.webhookTimeout = time.Second
+	}
+	w, err := newWebhook(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, rec
+}
+
+func TestWebhookEvents(t *testing.T) {
+	w, rec := newTestWebhook(t, http.StatusNoContent, settings{
+		webhookSecret:  testSecret,
+		webhookHeaders: headerList{"Authorization: Bearer abc"},
+	})
+	tr := &trigger{settings: &settings{webhook: w}}
+
+	domain := nimbusec.Domain{Id: 7, Name: "example.com", Scheme: "https", Bundle: "b1", DeepScan: "https://example.com"}
+	results := []nimbusec.Result{{Id: 1, Severity: 3, Threatname: "PHP.Shell"}}
+	infection := newInfection(domain, results)
+
+	if err := tr.send(EventInfected, domain, infection, results); err != nil {
+		t.Fatalf("infected: %v", err)
+	}
+	if err := tr.send(EventRecovered, infection.domain(domain.Name), Infection{Id: 7, Scheme: "https", Bundle: "b1"}, nil); err != nil {
+		t.Fatalf("recovered: %v", err)
+	}
+
+	requests := rec.get()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+
+	want := []WebhookData{
+		{Event: EventInfected, Domain: domain, Severity: 3, Threats: []string{"PHP.Shell"}, Results: results},
+		{Event: EventRecovered, Domain: nimbusec.Domain{Id: 7, Name: "example.com", Scheme: "https", Bundle: "b1"}, Threats: []string{}, Results: []nimbusec.Result{}},
+	}
+	for i, req := range requests {
+		if req.method != "POST" {
+			t.Errorf("%s: method %s, want POST", want[i].Event, req.method)
+		}
+		if got := req.header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: Content-Type %q, want application/json", want[i].Event, got)
+		}
+		if got := req.header.Get("Authorization"); got != "Bearer abc" {
+			t.Errorf("%s: Authorization %q, want Bearer abc", want[i].Event, got)
+		}
+		if got := req.header.Get(SignatureHeader); got != req.signature {
+			t.Errorf("%s: %s %q, want %q", want[i].Event, SignatureHeader, got, req.signature)
+		}
+
+		var got WebhookData
+		if err := json.Unmarshal(req.body, &got); err != nil {
+			t.Fatalf("%s: %v in %s", want[i].Event, err, req.body)
+		}
+		if got.Time.IsZero() {
+			t.Errorf("%s: time not set", want[i].Event)
+		}
+		got.Time = time.Time{}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("%s:\n got %+v\nwant %+v", want[i].Event, got, want[i])
+		}
+	}
+}
+
+func TestWebhookBody(t *testing.T) {
+	w, rec := newTestWebhook(t, http.StatusOK, settings{
+		webhookMethod: "put",
+		webhookBody:   `{"text": "{{.Domain.Name}} is {{.Event}}: {{json .Threats}}"}`,
+	})
+
+	data := WebhookData{Event: EventInfected, Domain: nimbusec.Domain{Name: "example.com"}, Threats: []string{"a", "b"}}
+	if err := w.Send(data); err != nil {
+		t.Fatal(err)
+	}
+
+	req := rec.get()[0]
+	if req.method != "PUT" {
+		t.Errorf("method %s, want PUT", req.method)
+	}
+	if got, want := string(req.body), `{"text": "example.com is infected: ["a","b"]"}`; got != want {
+		t.Errorf("body %s, want %s", got, want)
+	}
+	if got := req.header.Get(SignatureHeader); got != "" {
+		t.Errorf("%s %q without secret", SignatureHeader, got)
+	}
+}
+
+func TestWebhookFailures(t *testing.T) {
+	tests := []struct {
+		status   int
+		requests int
+		err      string
+	}{
+		{http.StatusForbidden, 1, "403 Forbidden"},
+		{http.StatusServiceUnavailable, 3, "503 Service Unavailable"},
+	}
+
+	for _, test := range tests {
+		w, rec := newTestWebhook(t, test.status, settings{webhookRetries: 2, webhookRetryDelay: time.Millisecond})
+
+		err := w.Send(WebhookData{Event: EventInfected})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("status %d: got error %v, want %q", test.status, err, test.err)
+		}
+		if n := len(rec.get()); n != test.requests {
+			t.Errorf("status %d: got %d requests, want %d", test.status, n, test.requests)
+		}
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	w, err := newWebhook(&settings{webhookURL: server.URL, webhookMethod: "POST", webhookTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Send(WebhookData{Event: EventRecovered}); err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("got error %v, want timeout", err)
+	}
+}
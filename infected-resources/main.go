@@ -1,27 +1,44 @@
 package main
 
 import (
-	"encoding/csv"
 	"flag"
 	"log"
 	"os"
-	"strconv"
 
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/output"
 	"github.com/cumulodev/nimbusec"
 )
 
+// fields of the result records
+var fields = []string{
+	"domain", "domainId", "id", "status", "event", "category", "severity", "probability", "safeToDelete",
+	"createDate", "lastDate", "threatname", "resource", "md5", "filesize", "owner", "group", "permission",
+	"diff", "reason",
+}
+
+const defaultFields = "domain,lastDate,resource,threatname,reason"
+
 func main() {
 	filter := flag.String("filter", "severity ge 3 and (event eq \"malware\" or event eq \"webshell\")", "filter for when a domain is considered infected")
 	domain := flag.String("domain", "ALL", "define specific domain or ALL to lookup over all domains and resources")
 	url := flag.String("url", nimbusec.DefaultAPI, "url to nimbusec API")
 	key := flag.String("key", "", "nimbusec API key")
 	secret := flag.String("secret", "", "nimbusec API secret")
+	configure := apiopts.Flags(flag.CommandLine)
+	outputFlags := output.Flags(flag.CommandLine, fields, defaultFields)
 	flag.Parse()
 
-	api, err := nimbusec.NewAPI(*url, *key, *secret)
+	writer, err := outputFlags(os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	api, err := apiopts.NewAPI(*url, *key, *secret)
 	if err != nil {
 		log.Fatal(err)
 	}
+	configure(api)
 
 	// find infected domains
 	var domains []nimbusec.Domain
@@ -40,16 +57,67 @@ func main() {
 	}
 
 	// fetch resources per domain
-	writer := csv.NewWriter(os.Stdout)
 	for _, domain := range domains {
 		results, err := api.FindResults(domain.Id, *filter)
 		if err != nil {
 			log.Fatal(err)
 		}
 		for _, result := range results {
-			writer.Write([]string{domain.Name, strconv.Itoa(result.LastDate), result.Resource, result.Threatname, result.Reason})
-			writer.Flush()
+			if err := writer.Write(record(domain, result)); err != nil {
+				log.Fatal(err)
+			}
 		}
 	}
+	if err := writer.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
 
+// record returns the field values of a result of the domain.
+func record(domain nimbusec.Domain, result nimbusec.Result) output.Record {
+	return func(field string) interface{} {
+		switch field {
+		case "domain":
+			return domain.Name
+		case "domainId":
+			return domain.Id
+		case "id":
+			return result.Id
+		case "status":
+			return result.Status
+		case "event":
+			return result.Event
+		case "category":
+			return result.Category
+		case "severity":
+			return result.Severity
+		case "probability":
+			return result.Probability
+		case "safeToDelete":
+			return result.SafeToDelete
+		case "createDate":
+			return output.Millis(result.CreateDate)
+		case "lastDate":
+			return output.Millis(result.LastDate)
+		case "threatname":
+			return result.Threatname
+		case "resource":
+			return result.Resource
+		case "md5":
+			return result.MD5
+		case "filesize":
+			return result.Filesize
+		case "owner":
+			return result.Owner
+		case "group":
+			return result.Group
+		case "permission":
+			return result.Permission
+		case "diff":
+			return result.Diff
+		case "reason":
+			return result.Reason
+		}
+		return nil
+	}
 }
@@ -0,0 +1,43 @@
+// Package agentconf reads and writes the agent.conf file of the nimbusec
+// server agent, which lists the domains the agent scans with their docroots.
+package agentconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Config is the configuration of a server agent.
+type Config struct {
+	Key           string            `json:"key"`
+	Secret        string            `json:"secret"`
+	Domains       map[string]string `json:"domains"` // docroot by domain name
+	TmpFile       string            `json:"tmpfile"`
+	ExcludeDir    []string          `json:"excludeDir"`
+	ExcludeRegexp []string          `json:"excludeRegexp"`
+	APIServer     string            `json:"apiserver"`
+}
+
+// Read reads an agent configuration from a file.
+func Read(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := new(Config)
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return conf, nil
+}
+
+// Marshal encodes the configuration as written by create-agent-config.
+func (c *Config) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,306 @@
+// Package apacheconf extracts the virtual hosts of an Apache httpd
+// configuration.
+//
+// The parser only understands as much of the configuration syntax as needed
+// to find virtual hosts: comments, line continuations, quoted arguments,
+// Include / IncludeOptional (with globs and directories) and the ServerName,
+// ServerAlias, DocumentRoot and SSLEngine directives inside <VirtualHost>
+// sections. Conditional sections like <IfModule> are always entered.
+package apacheconf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// VirtualHost is a <VirtualHost> section of the configuration.
+type VirtualHost struct {
+	File         string   // configuration file defining the virtual host
+	Line         int      // line of the <VirtualHost> directive
+	Addrs        []string // addresses of the section, e.g. *:443
+	SSL          bool     // whether the virtual host serves https
+	ServerName   string   // name of the virtual host without scheme and port
+	Aliases      []string // additional names of the virtual host
+	DocumentRoot string   // document root of the virtual host
+}
+
+// parser keeps the state while walking the configuration files.
+type parser struct {
+	root    string          // ServerRoot used to resolve relative paths
+	seen    map[string]bool // files already parsed, to break include cycles
+	vhosts  []VirtualHost
+	current *VirtualHost
+}
+
+// Parse reads the configuration starting at path, which is either the main
+// configuration file (e.g. /etc/apache2/apache2.conf) or a directory like
+// sites-enabled whose files are read in lexical order.
+func Parse(path string) ([]VirtualHost, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{
+		root: filepath.Dir(path),
+		seen: make(map[string]bool),
+	}
+
+	// path itself is not resolved against the root like included patterns
+	if info.IsDir() {
+		p.root = path
+		err = p.glob(filepath.Join(path, "*"), true)
+	} else {
+		err = p.parseFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.vhosts, nil
+}
+
+// include parses all files matched by the pattern of an Include directive,
+// which is relative to the ServerRoot.
+func (p *parser) include(pattern string, optional bool) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(p.root, pattern)
+	}
+	return p.glob(pattern, optional)
+}
+
+// glob parses all files matched by pattern. Directories are read
+// recursively. If optional is set, patterns matching nothing are ignored.
+func (p *parser) glob(pattern string, optional bool) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		if optional || strings.ContainsAny(pattern, "*?[") {
+			return nil
+		}
+		return fmt.Errorf("include %s: file not found", pattern)
+	}
+
+	sort.Strings(matches)
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if err := p.glob(filepath.Join(match, "*"), true); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := p.parseFile(match); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseFile parses a single configuration file.
+func (p *parser) parseFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if p.seen[abs] {
+		return nil
+	}
+	p.seen[abs] = true
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	line, start := 0, 0
+	logical := ""
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if logical == "" {
+			start = line
+		}
+
+		// join continued lines
+		if strings.HasSuffix(text, "\\") {
+			logical += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		logical += text
+
+		if err := p.directive(path, start, logical); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, start, err)
+		}
+		logical = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if logical != "" {
+		if err := p.directive(path, start, logical); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, start, err)
+		}
+	}
+
+	// a section may include files, but must end in the file it started in
+	if p.current != nil && p.current.File == path {
+		return fmt.Errorf("%s:%d: <VirtualHost> not closed", path, p.current.Line)
+	}
+	return nil
+}
+
+// directive handles a single logical configuration line.
+func (p *parser) directive(file string, line int, text string) error {
+	if text == "" || strings.HasPrefix(text, "#") {
+		return nil
+	}
+
+	fields := split(text)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	name := strings.ToLower(fields[0])
+	args := fields[1:]
+
+	switch name {
+	case "serverroot":
+		if len(args) > 0 {
+			p.root = args[0]
+		}
+
+	case "include", "includeoptional":
+		for _, arg := range args {
+			if err := p.include(arg, name == "includeoptional"); err != nil {
+				return err
+			}
+		}
+
+	case "<virtualhost":
+		if p.current != nil {
+			return fmt.Errorf("nested <VirtualHost> section")
+		}
+
+		addrs := make([]string, 0, len(args))
+		for _, arg := range args {
+			addrs = append(addrs, strings.TrimSuffix(arg, ">"))
+		}
+
+		p.current = &VirtualHost{
+			File:  file,
+			Line:  line,
+			Addrs: addrs,
+		}
+		for _, addr := range addrs {
+			if strings.HasSuffix(addr, ":443") {
+				p.current.SSL = true
+			}
+		}
+
+	case "</virtualhost>":
+		if p.current == nil {
+			return fmt.Errorf("unexpected </VirtualHost>")
+		}
+		p.vhosts = append(p.vhosts, *p.current)
+		p.current = nil
+	}
+
+	if p.current == nil {
+		return nil
+	}
+
+	switch name {
+	case "servername":
+		if len(args) > 0 {
+			host, ssl := hostname(args[0])
+			p.current.ServerName = host
+			p.current.SSL = p.current.SSL || ssl
+		}
+
+	case "serveralias":
+		for _, arg := range args {
+			host, _ := hostname(arg)
+			p.current.Aliases = append(p.current.Aliases, host)
+		}
+
+	case "documentroot":
+		if len(args) > 0 {
+			p.current.DocumentRoot = strings.TrimSuffix(args[0], "/")
+			if p.current.DocumentRoot == "" {
+				p.current.DocumentRoot = "/"
+			}
+		}
+
+	case "sslengine":
+		if len(args) > 0 && strings.ToLower(args[0]) == "on" {
+			p.current.SSL = true
+		}
+	}
+
+	return nil
+}
+
+// hostname strips the optional scheme and port of a ServerName argument. The
+// second return value reports whether the name uses the https scheme.
+func hostname(name string) (string, bool) {
+	ssl := strings.HasPrefix(strings.ToLower(name), "https://")
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[i+3:]
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(name), ssl
+}
+
+// split splits a configuration line into its directive and arguments while
+// respecting double and single quotes.
+func split(text string) []string {
+	fields := []string{}
+	var (
+		current []rune
+		quote   rune
+		inField bool
+	)
+
+	for _, r := range text {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current = append(current, r)
+		case r == '"' || r == '\'':
+			quote = r
+			inField = true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, string(current))
+				current = current[:0]
+				inField = false
+			}
+		default:
+			current = append(current, r)
+			inField = true
+		}
+	}
+
+	if inField {
+		fields = append(fields, string(current))
+	}
+	return fields
+}
@@ -0,0 +1,156 @@
+package apacheconf
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cumulodev/hoster-tools/internal/importcsv"
+)
+
+var (
+	sites    = filepath.Join("testdata", "apache2", "sites-enabled")
+	defaults = filepath.Join(sites, "000-default.conf")
+	ssl      = filepath.Join(sites, "001-ssl.conf")
+	wildcard = filepath.Join(sites, "002-wildcard.conf")
+	readme   = filepath.Join(sites, "README")
+)
+
+// vhosts are the virtual hosts of testdata/apache2 in configuration order.
+var vhosts = []VirtualHost{
+	{
+		File:         defaults,
+		Line:         1,
+		Addrs:        []string{"*:80"},
+		ServerName:   "example.com",
+		Aliases:      []string{"www.example.com", "*.example.com"},
+		DocumentRoot: "/var/www/example",
+	},
+	{
+		File:         ssl,
+		Line:         2,
+		Addrs:        []string{"*:443"},
+		SSL:          true,
+		ServerName:   "example.com",
+		DocumentRoot: "/var/www/example-ssl",
+	},
+	{
+		File:         ssl,
+		Line:         7,
+		Addrs:        []string{"_default_:8443"},
+		SSL:          true,
+		ServerName:   "secure.example.org",
+		DocumentRoot: "/var/www/secure",
+	},
+	{
+		File:         wildcard,
+		Line:         2,
+		Addrs:        []string{"*:80"},
+		ServerName:   "*.example.net",
+		Aliases:      []string{"blog.example.net"},
+		DocumentRoot: "/var/www/blog",
+	},
+}
+
+func TestParseIncludes(t *testing.T) {
+	got, err := Parse(filepath.Join("testdata", "apache2", "apache2.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, vhosts) {
+		t.Errorf("Parse:\n got %+v\nwant %+v", got, vhosts)
+	}
+}
+
+func TestParseDirectory(t *testing.T) {
+	got, err := Parse(sites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory includes all of its files, not only *.conf
+	want := append(vhosts[:len(vhosts):len(vhosts)], VirtualHost{
+		File:         readme,
+		Line:         2,
+		Addrs:        []string{"*:80"},
+		ServerName:   "readme.example.com",
+		DocumentRoot: "/var/www/readme",
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseMissingInclude(t *testing.T) {
+	_, err := Parse(filepath.Join("testdata", "missing.conf"))
+	if err == nil || !strings.Contains(err.Error(), "file not found") {
+		t.Errorf("Parse: got error %v, want file not found", err)
+	}
+}
+
+func TestParseUnclosed(t *testing.T) {
+	_, err := Parse(filepath.Join("testdata", "unclosed"))
+	want := filepath.Join("testdata", "unclosed", "000-a.conf") + ":1: <VirtualHost> not closed"
+	if err == nil || err.Error() != want {
+		t.Errorf("Parse: got error %v, want %s", err, want)
+	}
+}
+
+func TestDomains(t *testing.T) {
+	tests := []struct {
+		aliases bool
+		want    []importcsv.Domain
+		skipped []string
+	}{
+		{
+			aliases: false,
+			want: []importcsv.Domain{
+				{File: ssl, Line: 2, Name: "example.com", Path: "/var/www/example-ssl", Scheme: "https", Bundle: "b1"},
+				{File: ssl, Line: 7, Name: "secure.example.org", Path: "/var/www/secure", Scheme: "https", Bundle: "b1"},
+			},
+			skipped: []string{"*.example.net"},
+		},
+		{
+			aliases: true,
+			want: []importcsv.Domain{
+				{File: wildcard, Line: 2, Name: "blog.example.net", Path: "/var/www/blog", Scheme: "http", Bundle: "b1"},
+				{File: ssl, Line: 2, Name: "example.com", Path: "/var/www/example-ssl", Scheme: "https", Bundle: "b1"},
+				{File: ssl, Line: 7, Name: "secure.example.org", Path: "/var/www/secure", Scheme: "https", Bundle: "b1"},
+				{File: defaults, Line: 1, Name: "www.example.com", Path: "/var/www/example", Scheme: "http", Bundle: "b1"},
+			},
+			skipped: []string{"*.example.com", "*.example.net"},
+		},
+	}
+
+	for _, test := range tests {
+		got, skipped := Domains(vhosts, test.aliases, "b1")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Domains(aliases=%v):\n got %+v\nwant %+v", test.aliases, got, test.want)
+		}
+		if !reflect.DeepEqual(skipped, test.skipped) {
+			t.Errorf("Domains(aliases=%v): skipped %q, want %q", test.aliases, skipped, test.skipped)
+		}
+	}
+}
+
+func TestHostname(t *testing.T) {
+	tests := []struct {
+		in   string
+		name string
+		ssl  bool
+	}{
+		{"example.com", "example.com", false},
+		{"Example.COM:80", "example.com", false},
+		{"http://example.com", "example.com", false},
+		{"https://example.com:443", "example.com", true},
+	}
+
+	for _, test := range tests {
+		name, ssl := hostname(test.in)
+		if name != test.name || ssl != test.ssl {
+			t.Errorf("hostname(%q) = %q, %v; want %q, %v", test.in, name, ssl, test.name, test.ssl)
+		}
+	}
+}
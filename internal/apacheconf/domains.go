@@ -0,0 +1,61 @@
+package apacheconf
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/cumulodev/hoster-tools/internal/importcsv"
+)
+
+// Domains converts the virtual hosts into domain records. A name served by an
+// SSL virtual host gets the https scheme and the document root of the SSL
+// virtual host, otherwise http. With aliases set, every ServerAlias becomes a
+// domain of its own. Wildcard names can not be registered and are returned
+// separately.
+func Domains(vhosts []VirtualHost, aliases bool, bundle string) (domains []importcsv.Domain, skipped []string) {
+	byName := make(map[string]*importcsv.Domain)
+	for _, vhost := range vhosts {
+		names := []string{vhost.ServerName}
+		if aliases {
+			names = append(names, vhost.Aliases...)
+		}
+
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			if strings.ContainsAny(name, "*?") {
+				skipped = append(skipped, name)
+				continue
+			}
+
+			scheme := "http"
+			if vhost.SSL {
+				scheme = "https"
+			}
+
+			// the SSL virtual host wins over the plain http one
+			if existing, ok := byName[name]; ok && (existing.Scheme == "https" || !vhost.SSL) {
+				continue
+			}
+
+			byName[name] = &importcsv.Domain{
+				File:   vhost.File,
+				Line:   vhost.Line,
+				Name:   name,
+				Path:   vhost.DocumentRoot,
+				Scheme: scheme,
+				Bundle: bundle,
+			}
+		}
+	}
+
+	for _, domain := range byName {
+		domains = append(domains, *domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Name < domains[j].Name
+	})
+
+	return domains, skipped
+}
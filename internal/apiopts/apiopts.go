@@ -0,0 +1,39 @@
+// Package apiopts registers the command line flags that tune the nimbusec API
+// client. All tools talking to the API share these flags.
+//
+// The nimbusec client always uses http.DefaultTransport. To retry and rate
+// limit its requests, the package replaces http.DefaultTransport of the whole
+// process once the first API client is configured. Requests to other hosts,
+// e.g. of a webhook, pass the replacement unchanged, but they do go through
+// it if their client has no transport of its own.
+package apiopts
+
+import (
+	"flag"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// Flags registers the API client flags on the given flag set. The returned
+// function must be called after the flags were parsed and applies the
+// configured options to an API client. Like SetRetryPolicy, it replaces
+// http.DefaultTransport on first use.
+func Flags(fs *flag.FlagSet) func(api *nimbusec.API) {
+	def := DefaultRetryPolicy
+	retries := fs.Int("retries", def.Attempts-1, "number of retries of a failed API request (0 to disable)")
+	delay := fs.Duration("retry-delay", def.MinDelay, "delay before the first retry, doubled for every further retry")
+	maxDelay := fs.Duration("retry-max-delay", def.MaxDelay, "maximum delay between two retries")
+	budget := fs.Int("retry-budget", def.Budget, "maximum number of retries for the whole run (-1 for unlimited)")
+	rate := fs.Float64("rate", 0, "maximum API requests per second shared by all workers (0 for unlimited)")
+	burst := fs.Int("burst", 5, "number of API requests that may exceed the rate in a short burst")
+
+	return func(api *nimbusec.API) {
+		SetRetryPolicy(api, RetryPolicy{
+			Attempts: *retries + 1,
+			MinDelay: *delay,
+			MaxDelay: *maxDelay,
+			Budget:   *budget,
+		})
+		SetRateLimit(api, *rate, *burst)
+	}
+}
@@ -0,0 +1,27 @@
+package apiopts
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Delete calls a delete method of the API client, e.g.
+//
+//	err := apiopts.Delete(func() error { return api.DeleteUser(&user) })
+//
+// API.Delete of the nimbusec client closes the response body before checking
+// the error, so it panics if the request failed without response. Delete
+// turns that panic into an error, so a single failed delete does not stop a
+// whole run.
+func Delete(call func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); !ok {
+				panic(r)
+			}
+			err = fmt.Errorf("delete failed without response from the API: %v", r)
+		}
+	}()
+
+	return call()
+}
@@ -0,0 +1,21 @@
+package apiopts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+func TestDelete(t *testing.T) {
+	// nothing listens on port 1
+	api, err := NewAPI("http://127.0.0.1:1/", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Delete(func() error { return api.DeleteDomain(&nimbusec.Domain{Id: 1}, true) })
+	if err == nil || !strings.Contains(err.Error(), "without response") {
+		t.Errorf("Delete: got error %v, want delete failed without response", err)
+	}
+}
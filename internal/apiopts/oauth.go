@@ -0,0 +1,117 @@
+package apiopts
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// OAuth parameters replaced when a request is signed again
+const (
+	oauthConsumerKey = "oauth_consumer_key"
+	oauthNonce       = "oauth_nonce"
+	oauthSignature   = "oauth_signature"
+	oauthTimestamp   = "oauth_timestamp"
+)
+
+// oauthParams parses the Authorization header of a request signed by the
+// oauth package. The values stay escaped as they are in the header.
+func oauthParams(req *http.Request) map[string]string {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "OAuth ") {
+		return nil
+	}
+
+	params := make(map[string]string)
+	for _, param := range strings.Split(strings.TrimPrefix(header, "OAuth "), ",") {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		params[strings.TrimSpace(parts[0])] = strings.Trim(parts[1], `"`)
+	}
+	return params
+}
+
+// consumerKey returns the API key the request was signed with, or an empty
+// string if it is not signed.
+func consumerKey(req *http.Request) string {
+	return oauthParams(req)[oauthConsumerKey]
+}
+
+// sign signs the request again with the given timestamp and nonce, the same
+// way as the oauth package does for two-legged requests: the signature covers
+// the method, the URL without query and all OAuth and query parameters, but
+// not the body.
+func sign(req *http.Request, secret, timestamp, nonce string) {
+	params := oauthParams(req)
+	if params == nil {
+		return
+	}
+	delete(params, oauthSignature)
+	params[oauthTimestamp] = timestamp
+	params[oauthNonce] = nonce
+
+	all := make(map[string]string, len(params))
+	for key, value := range params {
+		all[key] = value
+	}
+	for key, values := range req.URL.Query() {
+		all[key] = escape(values[0])
+	}
+
+	base := *req.URL
+	base.RawQuery = ""
+	message := req.Method + "&" + escape(base.String())
+	for i, key := range sortedKeys(all) {
+		if i == 0 {
+			message += "&"
+		} else {
+			message += escape("&")
+		}
+		message += escape(key + "=" + all[key])
+	}
+
+	mac := hmac.New(sha1.New, []byte(escape(secret)+"&"))
+	mac.Write([]byte(message))
+	params[oauthSignature] = escape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	header := "OAuth "
+	for i, key := range sortedKeys(params) {
+		if i > 0 {
+			header += ","
+		}
+		header += key + `="` + params[key] + `"`
+	}
+	req.Header.Set("Authorization", header)
+}
+
+// sortedKeys returns the keys of the parameters sorted.
+func sortedKeys(params map[string]string) []string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escape percent-encodes everything but the unreserved characters of RFC 3986,
+// as required by OAuth.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte("0123456789ABCDEF"[c>>4])
+		b.WriteByte("0123456789ABCDEF"[c&15])
+	}
+	return b.String()
+}
@@ -0,0 +1,320 @@
+package apiopts
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// RetryPolicy describes how requests that were not processed by the API are
+// retried: requests rejected with 429, with 503 and a Retry-After header, or
+// failing to connect. Only idempotent requests (GET, PUT, DELETE) and upserts
+// are retried.
+type RetryPolicy struct {
+	Attempts int           // maximum number of attempts per request, 1 disables retries
+	MinDelay time.Duration // delay before the first retry, doubled for every further retry
+	MaxDelay time.Duration // upper bound for the delay between two attempts
+	Budget   int           // maximum number of retries until the policy is set again, negative for unlimited
+}
+
+var (
+	// NoRetry attempts every request exactly once. It applies to API
+	// clients that were not configured.
+	NoRetry = RetryPolicy{Attempts: 1}
+
+	// DefaultRetryPolicy retries a request up to 3 times, starting with a delay
+	// of one second.
+	DefaultRetryPolicy = RetryPolicy{
+		Attempts: 4,
+		MinDelay: 1 * time.Second,
+		MaxDelay: 30 * time.Second,
+		Budget:   100,
+	}
+)
+
+// The nimbusec client does not allow to replace its HTTP client, but sends
+// all requests through http.DefaultTransport. The transport installed there
+// applies the retry policy and rate limit of the API host and passes all other
+// requests on unchanged.
+var (
+	install   sync.Once
+	transport = &Transport{hosts: make(map[string]*host)}
+)
+
+// NewAPI creates a nimbusec API client. Unlike nimbusec.NewAPI, it registers
+// the secret of the key, so retries of the client's requests are signed again.
+// Like SetRetryPolicy, it replaces http.DefaultTransport on first use.
+func NewAPI(rawurl, key, secret string) (*nimbusec.API, error) {
+	api, err := nimbusec.NewAPI(rawurl, key, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	h := transport.host(api)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.secrets[key] = secret
+	return api, nil
+}
+
+// SetRetryPolicy configures how requests of the API client that failed with a
+// transient error are retried. Setting the policy renews the retry budget.
+//
+// The first call of SetRetryPolicy, SetRateLimit or NewAPI replaces
+// http.DefaultTransport for the whole process; requests to other hosts than
+// the API are passed on unchanged.
+func SetRetryPolicy(api *nimbusec.API, policy RetryPolicy) {
+	h := transport.host(api)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.policy = policy
+	h.retries = 0
+}
+
+// SetRateLimit limits the API client to rps requests per second with bursts
+// of up to burst requests. The limit is shared by all goroutines using the
+// client; retries count as requests. A rate of zero or less removes the limit.
+// Like SetRetryPolicy, it replaces http.DefaultTransport on first use.
+func SetRateLimit(api *nimbusec.API, rps float64, burst int) {
+	h := transport.host(api)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if rps <= 0 {
+		h.limiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	h.limiter = &limiter{
+		rate:   rps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Transport is an http.RoundTripper retrying and rate limiting the requests to
+// the configured API hosts. Requests to other hosts go to Base unchanged.
+//
+// A retried request gets a new OAuth nonce, timestamp and signature, as the
+// API rejects a nonce it has seen before. Requests signed with a key whose
+// secret is not known from NewAPI are not retried.
+type Transport struct {
+	Base http.RoundTripper
+
+	mu    sync.Mutex
+	hosts map[string]*host
+}
+
+// host holds the retry policy and rate limit of an API host.
+type host struct {
+	mu      sync.Mutex
+	policy  RetryPolicy
+	retries int               // retries spent of the retry budget
+	limiter *limiter          // shared request rate limit, nil if unlimited
+	secrets map[string]string // secrets of the API keys, to sign retries
+}
+
+// host returns the settings of the host of the API client, installing the
+// transport on first use.
+func (t *Transport) host(api *nimbusec.API) *host {
+	install.Do(func() {
+		t.Base = http.DefaultTransport
+		http.DefaultTransport = t
+	})
+
+	name := ""
+	if u, err := url.Parse(api.BuildURL("")); err == nil {
+		name = u.Host
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hosts[name]
+	if !ok {
+		h = &host{policy: NoRetry, secrets: make(map[string]string)}
+		t.hosts[name] = h
+	}
+	return h
+}
+
+// RoundTrip sends the request and retries it according to the retry policy
+// of its host if it was not processed and is safe to retry. Every attempt
+// waits for the rate limiter first.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	h := t.hosts[req.URL.Host]
+	t.mu.Unlock()
+	if h == nil {
+		return t.Base.RoundTrip(req)
+	}
+
+	h.mu.Lock()
+	policy := h.policy
+	limiter := h.limiter
+	secret, signed := h.secrets[consumerKey(req)]
+	h.mu.Unlock()
+
+	safe := signed && retrySafe(req) && (req.Body == nil || req.GetBody != nil)
+	attempt := req
+	for n := 1; ; n++ {
+		if limiter != nil {
+			limiter.wait()
+		}
+
+		resp, err := t.Base.RoundTrip(attempt)
+		if !safe || n >= policy.Attempts || !temporary(resp, err) || !h.spendRetry() {
+			return resp, err
+		}
+
+		delay := policy.backoff(n)
+		if wait, ok := retryAfter(resp); ok && wait > delay {
+			delay = wait
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		time.Sleep(delay)
+
+		attempt = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		sign(attempt, secret, strconv.FormatInt(time.Now().Unix(), 10), strconv.FormatInt(rand.Int63(), 10))
+	}
+}
+
+// spendRetry takes one retry from the retry budget. It returns false if the
+// budget is exhausted.
+func (h *host) spendRetry() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.policy.Budget >= 0 && h.retries >= h.policy.Budget {
+		return false
+	}
+
+	h.retries++
+	return true
+}
+
+// backoff returns the delay before the given retry attempt: an exponentially
+// growing delay of which the upper half is randomized.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.MinDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// retrySafe reports whether a request can be repeated without changing the
+// result. Upserts are idempotent, other POST requests are not.
+func retrySafe(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		_, upsert := req.URL.Query()["upsert"]
+		return upsert
+	}
+	return false
+}
+
+// temporary reports whether the failed request was not processed by the API
+// and might succeed when repeated. Other failures, like a timeout or a 502,
+// may happen after the API executed the request, so repeating it could apply
+// a change twice.
+func temporary(resp *http.Response, err error) bool {
+	if err != nil {
+		// the connection could not be established, nothing was sent
+		var op *net.OpError
+		return errors.As(err, &op) && op.Op == "dial"
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusServiceUnavailable:
+		_, ok := retryAfter(resp)
+		return ok
+	}
+	return false
+}
+
+// retryAfter parses the Retry-After header of the response, given either in
+// seconds or as HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		wait := date.Sub(time.Now())
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
+
+// limiter is a token bucket shared by all requests to an API host. The bucket
+// holds up to burst tokens and is refilled with rate tokens per second.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// wait blocks until the bucket grants a token. Tokens are reserved before
+// waiting, so concurrent callers are served in order.
+func (l *limiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens--
+	missing := -l.tokens
+	l.mu.Unlock()
+
+	if missing > 0 {
+		time.Sleep(time.Duration(missing / l.rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,134 @@
+package apiopts
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cumulodev/oauth"
+)
+
+// roundTripFunc captures the requests of the oauth package.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSign(t *testing.T) {
+	var signed *http.Request
+	consumer := oauth.NewConsumer("key", "s3cret&more", oauth.ServiceProvider{})
+	consumer.HttpClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		signed = req
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: make(http.Header)}, nil
+	})}
+
+	params := map[string]string{"q": `name eq "a b/c"`, "upsert": ""}
+	if _, err := consumer.Post("https://api.example.com/v2/domain", "application/json", "{}", params, &oauth.AccessToken{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// signing again with the same nonce and timestamp yields the same header
+	original := oauthParams(signed)
+	again := signed.Clone(signed.Context())
+	sign(again, "s3cret&more", original[oauthTimestamp], original[oauthNonce])
+	if got, want := again.Header.Get("Authorization"), signed.Header.Get("Authorization"); got != want {
+		t.Errorf("sign:\n got %s\nwant %s", got, want)
+	}
+
+	sign(again, "s3cret&more", original[oauthTimestamp], "42")
+	if got := oauthParams(again); got[oauthNonce] != "42" || got[oauthSignature] == original[oauthSignature] {
+		t.Errorf("sign with new nonce: got %v", got)
+	}
+}
+
+func TestRetrySignsAgain(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		nonces []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := oauthParams(r)
+
+		// the server sees the request without scheme and host
+		check := r.Clone(r.Context())
+		check.URL.Scheme = "http"
+		check.URL.Host = r.Host
+		sign(check, "secret", params[oauthTimestamp], params[oauthNonce])
+		valid := oauthParams(check)[oauthSignature] == params[oauthSignature]
+
+		mu.Lock()
+		nonces = append(nonces, params[oauthNonce])
+		attempt := len(nonces)
+		mu.Unlock()
+
+		switch {
+		case !valid:
+			w.WriteHeader(http.StatusUnauthorized)
+		case attempt == 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer server.Close()
+
+	api, err := NewAPI(server.URL, "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRetryPolicy(api, RetryPolicy{Attempts: 2, MinDelay: time.Millisecond, Budget: -1})
+
+	var dst map[string]interface{}
+	if err := api.Get(api.BuildURL("/v2/domain"), map[string]string{"q": "name eq \"x\""}, &dst); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(nonces) != 2 || nonces[0] == nonces[1] {
+		t.Errorf("got nonces %q, want two different ones", nonces)
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	response := func(status int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: make(http.Header)}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	// nothing listens on port 1
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:1/", nil)
+	_, refused := (&http.Transport{}).RoundTrip(req)
+
+	tests := []struct {
+		name string
+		resp *http.Response
+		err  error
+		want bool
+	}{
+		{"refused connection", nil, refused, true},
+		{"dial error", nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"read error", nil, &net.OpError{Op: "read", Err: errors.New("connection reset")}, false},
+		{"timeout", nil, errors.New("net/http: timeout awaiting response headers"), false},
+		{"429", response(http.StatusTooManyRequests, ""), nil, true},
+		{"503 with Retry-After", response(http.StatusServiceUnavailable, "2"), nil, true},
+		{"503", response(http.StatusServiceUnavailable, ""), nil, false},
+		{"502", response(http.StatusBadGateway, ""), nil, false},
+		{"504", response(http.StatusGatewayTimeout, "2"), nil, false},
+		{"500", response(http.StatusInternalServerError, ""), nil, false},
+	}
+
+	for _, test := range tests {
+		if got := temporary(test.resp, test.err); got != test.want {
+			t.Errorf("temporary(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Package archive keeps the security findings and history of a domain
+// before it is deleted.
+//
+// Deleting a domain with all its data erases its results, which hosters may
+// be required to keep for a while. Each domain is written into a compressed
+// tar archive of its own, holding the results, events, metadata, detected
+// applications and the current screenshot as JSON and image files.
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// maximum number of events archived per domain
+const maxEvents = 10000
+
+// Manifest describes the content of an archive.
+type Manifest struct {
+	Archived time.Time       `json:"archived"`           // time the archive was written
+	Domain   nimbusec.Domain `json:"domain"`             // the archived domain
+	Files    []string        `json:"files"`              // all files of the archive
+	Warnings []string        `json:"warnings,omitempty"` // optional parts that could not be archived
+}
+
+// Archiver writes domain archives into a directory. It is safe for
+// concurrent use; a nil Archiver archives nothing.
+type Archiver struct {
+	api *nimbusec.API
+	dir string
+}
+
+// New creates an archiver writing to dir, creating the directory if needed.
+// It returns nil if dir is empty.
+func New(api *nimbusec.API, dir string) (*Archiver, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Archiver{api: api, dir: dir}, nil
+}
+
+// file is a single file of an archive.
+type file struct {
+	name string
+	data []byte
+}
+
+// Archive fetches all data of the domain and writes it to a new archive named
+// after the domain and the current time. It returns the path of the archive.
+// The domain must not be deleted if Archive fails.
+func (a *Archiver) Archive(domain nimbusec.Domain) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+
+	files, warnings, err := a.fetch(domain)
+	if err != nil {
+		return "", fmt.Errorf("archive of %s: %v", domain.Name, err)
+	}
+
+	now := time.Now().UTC()
+	manifest := Manifest{
+		Archived: now,
+		Domain:   domain,
+		Warnings: warnings,
+	}
+	for _, f := range files {
+		manifest.Files = append(manifest.Files, f.name)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	files = append([]file{{"manifest.json", data}}, files...)
+
+	name := strings.Replace(domain.Name, string(filepath.Separator), "_", -1)
+	path := filepath.Join(a.dir, fmt.Sprintf("%s-%s.tar.gz", name, now.Format("20060102T150405.000000000Z")))
+	if err := write(path, name, now, files); err != nil {
+		return "", fmt.Errorf("archive of %s: %v", domain.Name, err)
+	}
+	return path, nil
+}
+
+// fetch collects the files of the archive. The screenshot is optional, as not
+// every domain has one; problems fetching it are returned as warnings.
+func (a *Archiver) fetch(domain nimbusec.Domain) ([]file, []string, error) {
+	files := []file{}
+	add := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "\t")
+		if err != nil {
+			return err
+		}
+		files = append(files, file{name, data})
+		return nil
+	}
+
+	results, err := a.api.FindResults(domain.Id, nimbusec.EmptyFilter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("results: %v", err)
+	}
+	if err := add("results.json", results); err != nil {
+		return nil, nil, err
+	}
+
+	events, err := a.api.GetDomainEvent(domain.Id, nimbusec.EmptyFilter, maxEvents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("events: %v", err)
+	}
+	if err := add("events.json", events); err != nil {
+		return nil, nil, err
+	}
+
+	metadata, err := a.api.GetDomainMetadata(domain.Id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("metadata: %v", err)
+	}
+	if err := add("metadata.json", metadata); err != nil {
+		return nil, nil, err
+	}
+
+	applications, err := a.api.GetDomainApplications(domain.Id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("applications: %v", err)
+	}
+	if err := add("applications.json", applications); err != nil {
+		return nil, nil, err
+	}
+
+	warnings := []string{}
+	screenshot, err := a.api.GetDomainScreenshot(domain.Id)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("screenshot: %v", err))
+		return files, warnings, nil
+	}
+	if err := add("screenshot.json", screenshot); err != nil {
+		return nil, nil, err
+	}
+
+	if screenshot.Current.URL != "" {
+		image, err := a.api.GetImage(screenshot.Current.URL)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("screenshot image: %v", err))
+		} else {
+			files = append(files, file{"screenshot" + extension(screenshot.Current.MimeType), image})
+		}
+	}
+
+	return files, warnings, nil
+}
+
+// extension returns the file extension of an image mime type.
+func extension(mime string) string {
+	switch mime {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/webp":
+		return ".webp"
+	}
+	return ".img"
+}
+
+// write stores the files as compressed tar archive in a directory named dir.
+// The archive is written to a temporary file first, so an interrupted run
+// never leaves a truncated archive behind. An existing file at path is never
+// replaced.
+func write(path, dir string, mtime time.Time, files []file) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".archive")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		header := &tar.Header{
+			Name:    dir + "/" + f.name,
+			Mode:    0644,
+			Size:    int64(len(f.data)),
+			ModTime: mtime,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// unlike rename, link fails if path already exists
+	return os.Link(tmp.Name(), path)
+}
@@ -0,0 +1,43 @@
+// Package deletion deletes domains only after they were saved.
+//
+// Before a domain is deleted, its results and history are archived (see
+// package archive) and its undo record is written (see package undo). If
+// either fails, the domain is kept, so a delete can always be inspected and
+// reverted afterwards.
+package deletion
+
+import (
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/archive"
+	"github.com/cumulodev/hoster-tools/internal/undo"
+	"github.com/cumulodev/nimbusec"
+)
+
+// Deleter deletes domains after saving them. It is safe for concurrent use.
+type Deleter struct {
+	api      *nimbusec.API
+	archiver *archive.Archiver // nil if domains are not archived
+	undo     *undo.Log         // nil if no undo records are kept
+}
+
+// New creates a deleter. The archiver and the undo log may be nil.
+func New(api *nimbusec.API, archiver *archive.Archiver, undo *undo.Log) *Deleter {
+	return &Deleter{
+		api:      api,
+		archiver: archiver,
+		undo:     undo,
+	}
+}
+
+// Delete archives the domain, saves its undo record and deletes it. With
+// clean set, all results and other data of the domain are removed as well.
+func (d *Deleter) Delete(domain nimbusec.Domain, clean bool) error {
+	// never delete a domain that could not be saved
+	if _, err := d.archiver.Archive(domain); err != nil {
+		return err
+	}
+	if err := d.undo.Save(domain); err != nil {
+		return err
+	}
+	return apiopts.Delete(func() error { return d.api.DeleteDomain(&domain, clean) })
+}
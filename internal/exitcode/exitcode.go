@@ -0,0 +1,12 @@
+// Package exitcode defines the exit codes shared by all tools, so cron
+// wrappers can tell the outcome of a run without parsing its output.
+package exitcode
+
+const (
+	OK          = 0   // everything succeeded
+	Fatal       = 1   // the tool could not run at all, as used by log.Fatal
+	Usage       = 2   // invalid command line, as used by the flag package
+	Partial     = 3   // some domains, users or notifications failed, see the output
+	Interrupted = 4   // stopped by a signal before everything was done
+	Forced      = 130 // stopped by a second signal, as used by shells for SIGINT
+)
@@ -0,0 +1,125 @@
+// Package guard protects a nimbusec account from accidental mass deletions.
+//
+// Tools collect all domains (or users, notifications, ...) they are about to
+// delete and let the guard check them before the first delete is issued. A
+// guard trips if a protected name would be deleted or if the deletions exceed
+// an absolute or a percentage ceiling. The ceilings can be overridden by
+// confirming the exact number of deletions.
+package guard
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Guard holds the limits for deletions in a single run.
+type Guard struct {
+	MaxDeletions int             // absolute ceiling of deletions, negative to disable
+	MaxPercent   float64         // ceiling of deletions in percent of all domains, negative to disable
+	Confirmed    int             // confirmed number of deletions, negative if not confirmed
+	Protected    map[string]bool // names that must never be deleted
+	Noun         string          // plural of the deleted objects used in messages, e.g. domains
+}
+
+// Flags registers the guard command line flags on the given flag set. The
+// noun is the plural of the deleted objects, e.g. domains. The returned
+// function must be called after the flags were parsed and builds the
+// configured guard.
+func Flags(fs *flag.FlagSet, noun string) func() (*Guard, error) {
+	max := fs.Int("max-deletions", 50, fmt.Sprintf("abort if more %s would be deleted (-1 to disable)", noun))
+	percent := fs.Float64("max-deletions-percent", 25, fmt.Sprintf("abort if more than this percentage of all %s would be deleted (-1 to disable)", noun))
+	confirm := fs.Int("confirm-deletions", -1, "confirm the exact number of deletions to override the deletion ceilings")
+	protected := fs.String("protected", "", "path to a file with names (one per line) that must never be deleted")
+
+	return func() (*Guard, error) {
+		g := &Guard{
+			MaxDeletions: *max,
+			MaxPercent:   *percent,
+			Confirmed:    *confirm,
+			Protected:    make(map[string]bool),
+			Noun:         noun,
+		}
+
+		if *protected != "" {
+			names, err := ReadProtected(*protected)
+			if err != nil {
+				return nil, err
+			}
+			g.Protected = names
+		}
+
+		return g, nil
+	}
+}
+
+// ReadProtected reads a list of names, one per line. Empty lines and
+// lines starting with # are ignored.
+func ReadProtected(path string) (map[string]bool, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names[line] = true
+	}
+
+	return names, scanner.Err()
+}
+
+// Check verifies that deleting the named objects out of total objects in the
+// account is allowed. A name is given once per deleted object, so several
+// objects may share a name. The returned error explains which guard tripped.
+func (g *Guard) Check(names []string, total int) error {
+	noun := g.Noun
+	if noun == "" {
+		noun = "domains"
+	}
+
+	protected := []string{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if g.Protected[name] && !seen[name] {
+			protected = append(protected, name)
+			seen[name] = true
+		}
+	}
+	if len(protected) > 0 {
+		return fmt.Errorf("refusing to delete protected %s: %s", noun, strings.Join(protected, ", "))
+	}
+
+	n := len(names)
+	if n == 0 {
+		return nil
+	}
+
+	if g.Confirmed >= 0 {
+		if g.Confirmed != n {
+			return fmt.Errorf("%d deletions confirmed, but %d %s would be deleted", g.Confirmed, n, noun)
+		}
+		return nil
+	}
+
+	if g.MaxDeletions >= 0 && n > g.MaxDeletions {
+		return fmt.Errorf("%d %s would be deleted, which exceeds the limit of %d deletions; use -confirm-deletions=%d if this is intended", n, noun, g.MaxDeletions, n)
+	}
+
+	if g.MaxPercent >= 0 && total > 0 {
+		percent := float64(n) * 100 / float64(total)
+		if percent > g.MaxPercent {
+			return fmt.Errorf("%d of %d %s (%.1f%%) would be deleted, which exceeds the limit of %.1f%%; use -confirm-deletions=%d if this is intended", n, total, noun, percent, g.MaxPercent, n)
+		}
+	}
+
+	return nil
+}
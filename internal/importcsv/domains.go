@@ -0,0 +1,315 @@
+package importcsv
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// columns of a domain import file
+const (
+	ColDomain   = "domain"
+	ColPath     = "path"
+	ColScheme   = "scheme"
+	ColBundle   = "bundleid"
+	ColDeeplink = "deeplink"
+	ColFastScan = "fastscan"
+)
+
+// DomainSchema is the schema of domain import files as written by
+// get-domains: domain,path,scheme,bundleid,deeplink followed by any number of
+// additional fast scan landing pages.
+var DomainSchema = Schema{
+	Columns:  []string{ColDomain, ColPath, ColScheme, ColBundle, ColDeeplink},
+	Repeated: ColFastScan,
+	Aliases: map[string]string{
+		"name":         ColDomain,
+		"servername":   ColDomain,
+		"docroot":      ColPath,
+		"documentroot": ColPath,
+		"bundle":       ColBundle,
+		"deepscan":     ColDeeplink,
+		"fastscans":    ColFastScan,
+		"landingpage":  ColFastScan,
+	},
+}
+
+// Domain is a single validated record of a domain import file.
+type Domain struct {
+	File      string   // source file if the domain was not read from an import file
+	Line      int      // line number in the source file
+	Name      string   // DNS name of the domain
+	Path      string   // document root of the domain on the server
+	Scheme    string   // http or https
+	Bundle    string   // ID of the nimbusec bundle
+	Deeplink  string   // optional starting point of the deep scan
+	FastScans []string // optional additional landing pages
+
+	// KeepFastScans is set if the import file has no fast scan column, so
+	// the landing pages of a registered domain are kept (see MergeFastScans).
+	// In files without header, a row without any field after the deeplink
+	// has no fast scan column.
+	KeepFastScans bool
+}
+
+// Options select the columns a tool requires.
+type Options struct {
+	Register bool // scheme and bundle are required to register domains
+	Docroot  bool // the document root is required for the agent configuration
+}
+
+var hostname = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// windowsPath matches absolute windows paths like C:\inetpub or \\server\share.
+var windowsPath = regexp.MustCompile(`^([a-zA-Z]:[\\/]|\\\\)`)
+
+// ReadDomainsFile reads and validates the domain import file at path.
+func ReadDomainsFile(path string, opts Options) ([]Domain, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	rows, err := Read(fh, DomainSchema)
+	problems, ok := err.(Errors)
+	if err != nil && !ok {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	domains := make([]Domain, 0, len(rows))
+	for _, row := range rows {
+		domain := Domain{
+			Line:          row.Line,
+			Name:          row.Get(ColDomain),
+			Path:          row.Get(ColPath),
+			Scheme:        strings.ToLower(row.Get(ColScheme)),
+			Bundle:        row.Get(ColBundle),
+			Deeplink:      row.Get(ColDeeplink),
+			KeepFastScans: row.Values(ColFastScan) == nil,
+		}
+		for _, link := range row.Values(ColFastScan) {
+			if link != "" {
+				domain.FastScans = append(domain.FastScans, link)
+			}
+		}
+		domains = append(domains, domain)
+	}
+
+	problems = append(problems, validate(domains, opts)...)
+	if err := problems.Err(); err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// Validate checks domains that were not read from an import file, e.g.
+// domains extracted from a webserver configuration.
+func Validate(domains []Domain, opts Options) error {
+	return validate(domains, opts).Err()
+}
+
+// validate checks all domains and returns every problem found.
+func validate(domains []Domain, opts Options) Errors {
+	var problems Errors
+	add := func(domain Domain, format string, args ...interface{}) {
+		problems = append(problems, Problem{
+			File: domain.File,
+			Line: domain.Line,
+			Msg:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	lines := make(map[string]int)
+	for _, domain := range domains {
+		key := strings.ToLower(domain.Name)
+		switch {
+		case domain.Name == "":
+			add(domain, "missing domain name")
+		case !ValidName(domain.Name):
+			add(domain, "invalid domain name %q", domain.Name)
+		case lines[key] > 0:
+			add(domain, "duplicate domain %q, already defined in line %d", domain.Name, lines[key])
+		default:
+			lines[key] = domain.Line
+		}
+
+		switch {
+		case domain.Path == "" && opts.Docroot:
+			add(domain, "missing document root")
+		case domain.Path != "" && !strings.HasPrefix(domain.Path, "/") && !windowsPath.MatchString(domain.Path):
+			add(domain, "document root %q is not an absolute path", domain.Path)
+		}
+
+		switch {
+		case domain.Scheme == "" && opts.Register:
+			add(domain, "missing scheme")
+		case domain.Scheme != "" && domain.Scheme != "http" && domain.Scheme != "https":
+			add(domain, "invalid scheme %q, expected http or https", domain.Scheme)
+		}
+
+		if domain.Bundle == "" && opts.Register {
+			add(domain, "missing bundle ID")
+		}
+
+		if opts.Register {
+			if _, err := domain.Nimbusec(); err != nil {
+				add(domain, "%v", err)
+			}
+		}
+	}
+
+	return problems
+}
+
+// ValidName reports whether name is a valid DNS name of a domain.
+func ValidName(name string) bool {
+	return len(name) <= 253 && hostname.MatchString(name)
+}
+
+// CheckBundles verifies that every domain references one of the given bundles.
+func CheckBundles(domains []Domain, bundles []nimbusec.Bundle) error {
+	known := make(map[string]bool)
+	for _, bundle := range bundles {
+		known[bundle.Id] = true
+	}
+
+	var problems Errors
+	for _, domain := range domains {
+		if !known[domain.Bundle] {
+			problems = append(problems, Problem{
+				File: domain.File,
+				Line: domain.Line,
+				Msg:  fmt.Sprintf("unknown bundle ID %q", domain.Bundle),
+			})
+		}
+	}
+	return problems.Err()
+}
+
+// Nimbusec converts the record to the domain registered in nimbusec. The
+// deeplink sets the starting point of the deep scan and the first landing
+// page, the additional fast scans add further landing pages.
+func (d Domain) Nimbusec() (nimbusec.Domain, error) {
+	domain := nimbusec.Domain{
+		Name:      d.Name,
+		Bundle:    d.Bundle,
+		Scheme:    d.Scheme,
+		FastScans: []string{},
+	}
+
+	links := append([]string{d.Deeplink}, d.FastScans...)
+	for i, link := range links {
+		target, err := ScanURL(d.Scheme, d.Name, link)
+		if err != nil {
+			return domain, err
+		}
+
+		if i == 0 {
+			domain.DeepScan = target
+		}
+		if !contains(domain.FastScans, target) {
+			domain.FastScans = append(domain.FastScans, target)
+		}
+	}
+
+	return domain, nil
+}
+
+// MergeFastScans adds the landing pages of the registered domain to the
+// desired domain of a record with KeepFastScans set. The deep scan URL of the
+// registered domain is only kept if it is still the deep scan URL.
+func MergeFastScans(desired, registered nimbusec.Domain) nimbusec.Domain {
+	fastScans := append([]string{}, desired.FastScans...)
+	for _, target := range registered.FastScans {
+		if target != registered.DeepScan && !contains(fastScans, target) {
+			fastScans = append(fastScans, target)
+		}
+	}
+	desired.FastScans = fastScans
+	return desired
+}
+
+// ScanURL resolves a deeplink of the import file to the URL that is scanned.
+// An empty deeplink or / points to the root of the domain, another relative
+// path starting with a slash is appended to the domain and anything else must
+// be an absolute http or https URL.
+func ScanURL(scheme, name, deeplink string) (string, error) {
+	base := scheme + "://" + name
+	if deeplink == "" || deeplink == "/" {
+		return base, nil
+	}
+
+	if strings.HasPrefix(deeplink, "/") {
+		if _, err := url.Parse(base + deeplink); err != nil {
+			return "", fmt.Errorf("invalid deeplink %q: %v", deeplink, err)
+		}
+		return base + deeplink, nil
+	}
+
+	parsed, err := url.Parse(deeplink)
+	if err != nil {
+		return "", fmt.Errorf("invalid deeplink %q: %v", deeplink, err)
+	}
+
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("invalid deeplink %q: expected a path starting with / or an absolute http(s) URL", deeplink)
+	}
+
+	return deeplink, nil
+}
+
+// Deeplink is the inverse of ScanURL. It returns the deeplink of the import
+// file that resolves to the given scanned URL.
+func Deeplink(scheme, name, target string) string {
+	base := scheme + "://" + name
+	switch {
+	case target == base || target == base+"/":
+		return ""
+	case strings.HasPrefix(target, base+"/"):
+		return strings.TrimPrefix(target, base)
+	}
+	return target
+}
+
+// FromNimbusec converts a remote domain back into an import record. The
+// document root is not known to nimbusec and stays empty.
+func FromNimbusec(domain nimbusec.Domain) Domain {
+	d := Domain{
+		Name:      domain.Name,
+		Scheme:    domain.Scheme,
+		Bundle:    domain.Bundle,
+		Deeplink:  Deeplink(domain.Scheme, domain.Name, domain.DeepScan),
+		FastScans: []string{},
+	}
+
+	// the deep scan URL is always scanned by the fast scan as well
+	for _, target := range domain.FastScans {
+		if target == domain.DeepScan {
+			continue
+		}
+
+		// an empty fast scan column is skipped when reading the import file,
+		// so the root of a domain with a sub-path deeplink is written as /
+		link := Deeplink(domain.Scheme, domain.Name, target)
+		if link == "" {
+			link = "/"
+		}
+		d.FastScans = append(d.FastScans, link)
+	}
+	return d
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
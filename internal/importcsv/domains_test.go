@@ -0,0 +1,171 @@
+package importcsv
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// writeFile writes text to an import file in a temporary directory.
+func writeFile(t *testing.T, text string) string {
+	path := filepath.Join(t.TempDir(), "import.csv")
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadDomainsFile(t *testing.T) {
+	text := `example.com,/var/www,HTTPS,b1,/shop,/a,,/b
+example.org,/srv,http,b2
+`
+
+	domains, err := ReadDomainsFile(writeFile(t, text), Options{Register: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Domain{
+		{Line: 1, Name: "example.com", Path: "/var/www", Scheme: "https", Bundle: "b1", Deeplink: "/shop", FastScans: []string{"/a", "/b"}},
+		{Line: 2, Name: "example.org", Path: "/srv", Scheme: "http", Bundle: "b2", KeepFastScans: true},
+	}
+	if !reflect.DeepEqual(domains, want) {
+		t.Errorf("ReadDomainsFile:\n got %+v\nwant %+v", domains, want)
+	}
+}
+
+func TestKeepFastScans(t *testing.T) {
+	text := `domain,scheme,bundleid,deeplink,fastscan
+a.example.com,https,b1,/shop,/a
+b.example.com,https,b1,/shop,
+`
+	domains, err := ReadDomainsFile(writeFile(t, text+"c.example.com,https,b1,/shop\n"), Options{Register: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{false, false, false} {
+		if domains[i].KeepFastScans != want {
+			t.Errorf("%s: KeepFastScans = %v, want %v", domains[i].Name, domains[i].KeepFastScans, want)
+		}
+	}
+
+	// without a fast scan column in the header
+	domains, err = ReadDomainsFile(writeFile(t, "domain,scheme,bundleid,deeplink\nexample.com,https,b1,/shop\n"), Options{Register: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !domains[0].KeepFastScans {
+		t.Errorf("KeepFastScans not set without fast scan column")
+	}
+
+	desired, err := domains[0].Nimbusec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := nimbusec.Domain{
+		DeepScan:  "https://example.com/old",
+		FastScans: []string{"https://example.com/old", "https://example.com", "https://example.com/shop"},
+	}
+	merged := MergeFastScans(desired, registered)
+	if want := []string{"https://example.com/shop", "https://example.com"}; !reflect.DeepEqual(merged.FastScans, want) {
+		t.Errorf("MergeFastScans: got %q, want %q", merged.FastScans, want)
+	}
+	if len(desired.FastScans) != 1 {
+		t.Errorf("MergeFastScans changed the desired domain: %q", desired.FastScans)
+	}
+}
+
+func TestScanURL(t *testing.T) {
+	tests := []struct {
+		deeplink string
+		want     string
+		err      bool
+	}{
+		{"", "https://example.com", false},
+		{"/", "https://example.com", false},
+		{"/shop?id=1", "https://example.com/shop?id=1", false},
+		{"http://cdn.example.com/x", "http://cdn.example.com/x", false},
+		{"shop", "", true},
+		{"ftp://example.com/", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := ScanURL("https", "example.com", test.deeplink)
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("ScanURL(%q) = %q, %v; want %q", test.deeplink, got, err, test.want)
+		}
+	}
+}
+
+func TestDeeplink(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"https://example.com", ""},
+		{"https://example.com/", ""},
+		{"https://example.com/shop", "/shop"},
+		{"https://example.com.evil.net/", "https://example.com.evil.net/"},
+		{"http://example.com/shop", "http://example.com/shop"},
+	}
+
+	for _, test := range tests {
+		if got := Deeplink("https", "example.com", test.target); got != test.want {
+			t.Errorf("Deeplink(%q) = %q, want %q", test.target, got, test.want)
+		}
+	}
+}
+
+// TestRoundTrip writes remote domains as import rows like get-domains does and
+// reads them back like sync-domains does.
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		remote nimbusec.Domain
+		row    string
+	}{
+		{
+			remote: nimbusec.Domain{
+				DeepScan:  "https://example.com",
+				FastScans: []string{"https://example.com"},
+			},
+			row: "example.com,,https,b1,",
+		},
+		{
+			remote: nimbusec.Domain{
+				DeepScan:  "https://example.com/shop",
+				FastScans: []string{"https://example.com/shop", "https://example.com", "https://cdn.example.com/a"},
+			},
+			row: "example.com,,https,b1,/shop,/,https://cdn.example.com/a",
+		},
+	}
+
+	for _, test := range tests {
+		remote := test.remote
+		remote.Name = "example.com"
+		remote.Scheme = "https"
+		remote.Bundle = "b1"
+
+		record := FromNimbusec(remote)
+		row := strings.Join(append([]string{record.Name, record.Path, record.Scheme, record.Bundle, record.Deeplink}, record.FastScans...), ",")
+		if row != test.row {
+			t.Errorf("FromNimbusec(%s) = %q, want %q", remote.DeepScan, row, test.row)
+			continue
+		}
+
+		domains, err := ReadDomainsFile(writeFile(t, row+"\n"), Options{Register: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		back, err := domains[0].Nimbusec()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(back, remote) {
+			t.Errorf("round trip of %s:\n got %+v\nwant %+v", remote.DeepScan, back, remote)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Package importcsv reads the CSV import files of the hoster tools.
+//
+// An import file may start with a header line naming its columns, in which
+// case the columns can be given in any order. Files without header use the
+// column order of the schema. All problems of a file are collected and
+// reported together with their line numbers.
+package importcsv
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Schema describes the columns of an import file.
+type Schema struct {
+	Columns  []string          // column names in the order of files without header
+	Aliases  map[string]string // alternative header names of columns
+	Repeated string            // column that may be given multiple times; takes all surplus fields of files without header
+}
+
+// Row is a single record of an import file.
+type Row struct {
+	Line   int // line number in the import file
+	values map[string][]string
+}
+
+// Get returns the value of the named column or an empty string.
+func (r Row) Get(column string) string {
+	if values := r.values[column]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns all values of a repeated column.
+func (r Row) Values(column string) []string {
+	return r.values[column]
+}
+
+// Problem is a single error in an import file.
+type Problem struct {
+	File string // source of the record if not read from the import file
+	Line int
+	Msg  string
+}
+
+// Errors collects all problems found in an import file.
+type Errors []Problem
+
+// Add records a problem found at the given line.
+func (e *Errors) Add(line int, format string, args ...interface{}) {
+	*e = append(*e, Problem{
+		Line: line,
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Err returns the problems ordered by line as error or nil if there are none.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(e, func(i, j int) bool {
+		if e[i].File != e[j].File {
+			return e[i].File < e[j].File
+		}
+		return e[i].Line < e[j].Line
+	})
+	return e
+}
+
+func (e Errors) Error() string {
+	lines := make([]string, len(e))
+	for i, problem := range e {
+		if problem.File != "" {
+			lines[i] = fmt.Sprintf("%s:%d: %s", problem.File, problem.Line, problem.Msg)
+		} else {
+			lines[i] = fmt.Sprintf("line %d: %s", problem.Line, problem.Msg)
+		}
+	}
+	return fmt.Sprintf("%d problems in import file:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// Read parses an import file. Lines starting with # and empty lines are
+// skipped. Surrounding whitespace of all fields is removed.
+func Read(r io.Reader, schema Schema) ([]Row, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	var (
+		rows     []Row
+		problems Errors
+		columns  []string
+		first    = true
+	)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+
+		if first {
+			first = false
+			if header, ok := schema.header(record); ok {
+				columns = header
+				for i, name := range columns {
+					if name == "" && record[i] != "" {
+						problems.Add(line, "unknown column %q", record[i])
+					}
+				}
+				continue
+			}
+		}
+
+		if empty(record) {
+			continue
+		}
+
+		row := Row{
+			Line:   line,
+			values: make(map[string][]string),
+		}
+		for i, value := range record {
+			name := ""
+			switch {
+			case columns != nil && i < len(columns):
+				name = columns[i]
+			case columns == nil && i < len(schema.Columns):
+				name = schema.Columns[i]
+			case columns == nil:
+				name = schema.Repeated
+			}
+
+			if name == "" {
+				// unknown header columns were already reported
+				if (columns == nil || i >= len(columns)) && value != "" {
+					problems.Add(line, "unexpected value %q in column %d", value, i+1)
+				}
+				continue
+			}
+			row.values[name] = append(row.values[name], value)
+		}
+
+		// with a header, every named column is present, if only empty
+		for i := len(record); i < len(columns); i++ {
+			if name := columns[i]; name != "" {
+				row.values[name] = append(row.values[name], "")
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, problems.Err()
+}
+
+// header checks whether the record is a header line. A header must name the
+// first column of the schema. The returned slice maps field indices to column
+// names, with empty names for unknown columns.
+func (s Schema) header(record []string) ([]string, bool) {
+	columns := make([]string, len(record))
+	found := false
+	for i, field := range record {
+		name := s.column(field)
+		if name == s.Columns[0] {
+			found = true
+		}
+		columns[i] = name
+	}
+	return columns, found
+}
+
+// column resolves a header field to its column name.
+func (s Schema) column(field string) string {
+	field = strings.ToLower(strings.TrimSpace(field))
+	for _, name := range s.Columns {
+		if field == name {
+			return name
+		}
+	}
+	if s.Repeated != "" && field == s.Repeated {
+		return s.Repeated
+	}
+	return s.Aliases[field]
+}
+
+// empty reports whether all fields of the record are empty.
+func empty(record []string) bool {
+	for _, field := range record {
+		if field != "" {
+			return false
+		}
+	}
+	return true
+}
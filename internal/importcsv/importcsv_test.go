@@ -0,0 +1,126 @@
+package importcsv
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	text := `# columns in any order, with aliases and surrounding whitespace
+bundle, Domain ,scheme,docroot,landingpage,landingpage
+b1,example.com,https,/var/www,/a,/b
+
+b2,example.org,http,/srv,,
+`
+
+	rows, err := Read(strings.NewReader(text), DomainSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Row{
+		{Line: 3, values: map[string][]string{
+			ColBundle:   {"b1"},
+			ColDomain:   {"example.com"},
+			ColScheme:   {"https"},
+			ColPath:     {"/var/www"},
+			ColFastScan: {"/a", "/b"},
+		}},
+		{Line: 5, values: map[string][]string{
+			ColBundle:   {"b2"},
+			ColDomain:   {"example.org"},
+			ColScheme:   {"http"},
+			ColPath:     {"/srv"},
+			ColFastScan: {"", ""},
+		}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("Read:\n got %+v\nwant %+v", rows, want)
+	}
+	if got := rows[0].Get(ColDeeplink); got != "" {
+		t.Errorf("Get(%s) = %q, want empty", ColDeeplink, got)
+	}
+}
+
+func TestReadWithoutHeader(t *testing.T) {
+	text := "example.com,/var/www,https,b1,/deep,/f1,/f2\n"
+
+	rows, err := Read(strings.NewReader(text), DomainSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Row{
+		{Line: 1, values: map[string][]string{
+			ColDomain:   {"example.com"},
+			ColPath:     {"/var/www"},
+			ColScheme:   {"https"},
+			ColBundle:   {"b1"},
+			ColDeeplink: {"/deep"},
+			ColFastScan: {"/f1", "/f2"},
+		}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("Read:\n got %+v\nwant %+v", rows, want)
+	}
+}
+
+func TestReadProblems(t *testing.T) {
+	schema := Schema{Columns: []string{"name", "id"}}
+	tests := []struct {
+		text string
+		want Errors
+	}{
+		{
+			text: "name,color\na,red\n",
+			want: Errors{{Line: 1, Msg: `unknown column "color"`}},
+		},
+		{
+			text: "a,1\nb,2,extra\nc,3,,\n",
+			want: Errors{{Line: 2, Msg: `unexpected value "extra" in column 3`}},
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Read(strings.NewReader(test.text), schema)
+		if !reflect.DeepEqual(err, test.want) {
+			t.Errorf("Read(%q): got error %v, want %v", test.text, err, test.want)
+		}
+	}
+}
+
+func TestReadDomainsFileLines(t *testing.T) {
+	text := `domain,path,scheme,bundleid
+example.com,/var/www,https,b1
+# comment lines count as well
+bad_name,/var/www,http,b1
+EXAMPLE.com,relative,ftp,
+,C:\inetpub,http,b1
+`
+
+	_, err := ReadDomainsFile(writeFile(t, text), Options{Register: true, Docroot: true})
+	want := Errors{
+		{Line: 4, Msg: `invalid domain name "bad_name"`},
+		{Line: 5, Msg: `duplicate domain "EXAMPLE.com", already defined in line 2`},
+		{Line: 5, Msg: `document root "relative" is not an absolute path`},
+		{Line: 5, Msg: `invalid scheme "ftp", expected http or https`},
+		{Line: 5, Msg: "missing bundle ID"},
+		{Line: 6, Msg: "missing domain name"},
+	}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("ReadDomainsFile:\n got %v\nwant %v", err, want)
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	domains := []Domain{
+		{File: "b.conf", Line: 3, Name: "example.com", Path: "/var/www"},
+		{File: "a.conf", Line: 9, Name: "example.org"},
+	}
+
+	err := Validate(domains, Options{Docroot: true})
+	if err == nil || err.Error() != "1 problems in import file:\na.conf:9: missing document root" {
+		t.Errorf("Validate: got error %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+// Package interrupt lets tools finish their in-flight work when they are
+// asked to stop.
+//
+// After the first SIGINT or SIGTERM a tool should stop dispatching new jobs
+// and wait for the running ones. A second signal exits immediately.
+package interrupt
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/cumulodev/hoster-tools/internal/exitcode"
+)
+
+// Handler records whether the tool was asked to stop.
+type Handler struct {
+	stopped int32
+}
+
+// Notify starts watching for SIGINT and SIGTERM.
+func Notify() *Handler {
+	h := new(Handler)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		atomic.StoreInt32(&h.stopped, 1)
+		log.Printf("received %s, waiting for running jobs to finish (send again to exit immediately)", sig)
+
+		sig = <-signals
+		log.Printf("received %s again, exiting", sig)
+		os.Exit(exitcode.Forced)
+	}()
+
+	return h
+}
+
+// Stopped reports whether a signal was received.
+func (h *Handler) Stopped() bool {
+	return atomic.LoadInt32(&h.stopped) == 1
+}
@@ -0,0 +1,91 @@
+package nginxconf
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/cumulodev/hoster-tools/internal/importcsv"
+)
+
+// Skipped is a server name that can not be mapped to a document root.
+type Skipped struct {
+	File   string
+	Line   int
+	Name   string
+	Reason string
+}
+
+// Domains converts the server blocks into domain records. A name served by an
+// SSL server block gets the https scheme and the root of that block,
+// otherwise http. Wildcard, regex and catch-all names as well as servers
+// without root can not be mapped to a document root and are returned
+// separately.
+func Domains(servers []Server) (domains []importcsv.Domain, skipped []Skipped) {
+	byName := make(map[string]*importcsv.Domain)
+	for _, server := range servers {
+		for _, name := range server.Names {
+			skip := func(reason string) {
+				skipped = append(skipped, Skipped{
+					File:   server.File,
+					Line:   server.Line,
+					Name:   name,
+					Reason: reason,
+				})
+			}
+
+			switch {
+			case strings.HasPrefix(name, "~"):
+				skip("regular expression")
+				continue
+			case strings.Contains(name, "*"):
+				skip("wildcard name")
+				continue
+			case strings.Contains(name, "$"):
+				skip("variable in name")
+				continue
+			case strings.HasPrefix(name, "."):
+				// .example.com matches example.com and all its subdomains;
+				// only the exact name can be mapped
+				skip("wildcard name, only " + name[1:] + " is used")
+				name = name[1:]
+			}
+
+			if name == "" || name == "_" || !importcsv.ValidName(name) {
+				skip("not a domain name")
+				continue
+			}
+			if server.Root == "" {
+				skip("no root")
+				continue
+			}
+
+			scheme := "http"
+			if server.SSL {
+				scheme = "https"
+			}
+
+			// the SSL server block wins over the plain http one
+			name = strings.ToLower(name)
+			if existing, ok := byName[name]; ok && (existing.Scheme == "https" || !server.SSL) {
+				continue
+			}
+
+			byName[name] = &importcsv.Domain{
+				File:   server.File,
+				Line:   server.Line,
+				Name:   name,
+				Path:   server.Root,
+				Scheme: scheme,
+			}
+		}
+	}
+
+	for _, domain := range byName {
+		domains = append(domains, *domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Name < domains[j].Name
+	})
+
+	return domains, skipped
+}
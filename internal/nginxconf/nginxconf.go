@@ -0,0 +1,289 @@
+// Package nginxconf extracts the server blocks of an nginx configuration.
+//
+// The configuration is tokenized like nginx does it: directives end with a
+// semicolon, blocks are enclosed in braces, # starts a comment and arguments
+// may be quoted. Include directives are expanded in place, so included files
+// may contain complete server blocks or parts of them.
+package nginxconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Server is a server block of the configuration.
+type Server struct {
+	File  string   // configuration file defining the server block
+	Line  int      // line of the server directive
+	Names []string // all names of the server_name directives
+	SSL   bool     // whether the server listens for https
+	Root  string   // document root of the server
+}
+
+// token is a single word, string or special character of the configuration.
+type token struct {
+	file  string
+	line  int
+	value string
+	quote bool // quoted strings are never special characters
+}
+
+// Parse reads the configuration starting at the main configuration file
+// (e.g. /etc/nginx/nginx.conf). Relative include paths are resolved against
+// the directory of this file.
+func Parse(path string) ([]Server, error) {
+	p := &parser{
+		prefix: filepath.Dir(path),
+	}
+
+	tokens, err := p.tokenize(path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	p.tokens = tokens
+	if err := p.block(false, nil); err != nil {
+		return nil, err
+	}
+	return p.servers, nil
+}
+
+// parser walks the token stream of the configuration.
+type parser struct {
+	prefix  string
+	tokens  []token
+	pos     int
+	servers []Server
+}
+
+// maxDepth limits nested includes to break include cycles.
+const maxDepth = 16
+
+// tokenize splits the file into tokens and expands include directives.
+func (p *parser) tokenize(path string, depth int) ([]token, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%s: includes nested too deeply", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := lex(path, string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]token, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		// include <pattern>;
+		if raw[i].value == "include" && !raw[i].quote && i+2 < len(raw) && raw[i+2].value == ";" {
+			pattern := raw[i+1].value
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(p.prefix, pattern)
+			}
+
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", raw[i].file, raw[i].line, err)
+			}
+			if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+				return nil, fmt.Errorf("%s:%d: include %s: file not found", raw[i].file, raw[i].line, pattern)
+			}
+
+			sort.Strings(matches)
+			for _, match := range matches {
+				included, err := p.tokenize(match, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, included...)
+			}
+
+			i += 2
+			continue
+		}
+
+		tokens = append(tokens, raw[i])
+	}
+
+	return tokens, nil
+}
+
+// lex splits the configuration text into tokens.
+func lex(file, text string) ([]token, error) {
+	var (
+		tokens  []token
+		current []rune
+		line    = 1
+		start   = 1
+		quote   rune
+		escaped bool
+		comment bool
+	)
+
+	flush := func() {
+		if len(current) > 0 {
+			tokens = append(tokens, token{file: file, line: start, value: string(current)})
+			current = current[:0]
+		}
+	}
+
+	for _, r := range text {
+		if r == '\n' {
+			line++
+		}
+
+		switch {
+		case comment:
+			if r == '\n' {
+				comment = false
+			}
+
+		case quote != 0 && escaped:
+			current = append(current, r)
+			escaped = false
+
+		case quote != 0 && r == '\\':
+			escaped = true
+
+		case quote != 0 && r == quote:
+			tokens = append(tokens, token{file: file, line: start, value: string(current), quote: true})
+			current = current[:0]
+			quote = 0
+
+		case quote != 0:
+			current = append(current, r)
+
+		case r == '"' || r == '\'':
+			flush()
+			quote = r
+			start = line
+
+		case r == '#':
+			flush()
+			comment = true
+
+		case r == ';' || r == '{' || r == '}':
+			flush()
+			tokens = append(tokens, token{file: file, line: line, value: string(r)})
+
+		case r == ' ' || r == '\t' || r == '\r' || r == '\n':
+			flush()
+
+		default:
+			if len(current) == 0 {
+				start = line
+			}
+			current = append(current, r)
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("%s:%d: unterminated string", file, start)
+	}
+
+	flush()
+	return tokens, nil
+}
+
+// block parses directives until the end of the current block. Directives of
+// server blocks are recorded into server.
+func (p *parser) block(nested bool, server *Server) error {
+	for p.pos < len(p.tokens) {
+		first := p.tokens[p.pos]
+		if first.value == "}" && !first.quote {
+			if !nested {
+				return fmt.Errorf("%s:%d: unexpected }", first.file, first.line)
+			}
+			p.pos++
+			return nil
+		}
+
+		// collect the arguments up to ; or {
+		args := []string{}
+		p.pos++
+		for p.pos < len(p.tokens) {
+			t := p.tokens[p.pos]
+			if !t.quote && (t.value == ";" || t.value == "{") {
+				break
+			}
+			args = append(args, t.value)
+			p.pos++
+		}
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("%s:%d: unexpected end of configuration", first.file, first.line)
+		}
+
+		end := p.tokens[p.pos]
+		p.pos++
+
+		if end.value == "{" {
+			switch {
+			case first.value == "server" && server == nil:
+				s := Server{File: first.file, Line: first.line}
+				if err := p.block(true, &s); err != nil {
+					return err
+				}
+				p.servers = append(p.servers, s)
+
+			case first.value == "location" && server != nil:
+				// a root of the location / serves as root of the server
+				root := ""
+				location := Server{}
+				if err := p.block(true, &location); err != nil {
+					return err
+				}
+				if len(args) > 0 && args[len(args)-1] == "/" {
+					root = location.Root
+				}
+				if server.Root == "" {
+					server.Root = root
+				}
+
+			default:
+				if err := p.block(true, server); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if server != nil {
+			server.directive(first.value, args)
+		}
+	}
+
+	if nested {
+		return fmt.Errorf("unexpected end of configuration, missing }")
+	}
+	return nil
+}
+
+// directive records the directives of a server block that are needed to map
+// names to document roots.
+func (s *Server) directive(name string, args []string) {
+	switch name {
+	case "server_name":
+		s.Names = append(s.Names, args...)
+
+	case "listen":
+		for i, arg := range args {
+			if arg == "ssl" || (i == 0 && (arg == "443" || strings.HasSuffix(arg, ":443"))) {
+				s.SSL = true
+			}
+		}
+
+	case "root":
+		if len(args) > 0 {
+			s.Root = strings.TrimSuffix(args[0], "/")
+			if s.Root == "" {
+				s.Root = "/"
+			}
+		}
+	}
+}
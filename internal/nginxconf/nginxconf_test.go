@@ -0,0 +1,100 @@
+package nginxconf
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cumulodev/hoster-tools/internal/importcsv"
+)
+
+var (
+	sites    = filepath.Join("testdata", "nginx", "sites-enabled")
+	defaults = filepath.Join(sites, "default")
+	example  = filepath.Join(sites, "example.com")
+	skipped  = filepath.Join(sites, "skipped")
+)
+
+// servers are the server blocks of testdata/nginx in configuration order.
+var servers = []Server{
+	{File: defaults, Line: 2, Names: []string{"_"}, Root: "/var/www/html"},
+	{File: example, Line: 1, Names: []string{"Example.com", "www.example.com"}, Root: "/var/www/example"},
+	{File: example, Line: 7, Names: []string{"example.com", ".example.org"}, SSL: true, Root: "/var/www/example-ssl"},
+	{File: skipped, Line: 1, Names: []string{"*.example.net", `~^(?<user>.+)\.example\.net$`, "$host"}, SSL: true, Root: "/var/www/users"},
+	{File: skipped, Line: 7, Names: []string{"noroot.example.net"}},
+}
+
+func TestParse(t *testing.T) {
+	got, err := Parse(filepath.Join("testdata", "nginx", "nginx.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, servers) {
+		t.Errorf("Parse:\n got %+v\nwant %+v", got, servers)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		file string
+		err  string
+	}{
+		{"unterminated.conf", "unterminated.conf:2: unterminated string"},
+		{"unbalanced.conf", "missing }"},
+		{"does-not-exist.conf", "no such file"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(filepath.Join("testdata", test.file))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Parse(%s): got error %v, want %q", test.file, err, test.err)
+		}
+	}
+}
+
+func TestDomains(t *testing.T) {
+	want := []importcsv.Domain{
+		{File: example, Line: 7, Name: "example.com", Path: "/var/www/example-ssl", Scheme: "https"},
+		{File: example, Line: 7, Name: "example.org", Path: "/var/www/example-ssl", Scheme: "https"},
+		{File: example, Line: 1, Name: "www.example.com", Path: "/var/www/example", Scheme: "http"},
+	}
+	wantSkipped := []Skipped{
+		{File: defaults, Line: 2, Name: "_", Reason: "not a domain name"},
+		{File: example, Line: 7, Name: ".example.org", Reason: "wildcard name, only example.org is used"},
+		{File: skipped, Line: 1, Name: "*.example.net", Reason: "wildcard name"},
+		{File: skipped, Line: 1, Name: `~^(?<user>.+)\.example\.net$`, Reason: "regular expression"},
+		{File: skipped, Line: 1, Name: "$host", Reason: "variable in name"},
+		{File: skipped, Line: 7, Name: "noroot.example.net", Reason: "no root"},
+	}
+
+	got, gotSkipped := Domains(servers)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Domains:\n got %+v\nwant %+v", got, want)
+	}
+	if !reflect.DeepEqual(gotSkipped, wantSkipped) {
+		t.Errorf("Domains: skipped\n got %+v\nwant %+v", gotSkipped, wantSkipped)
+	}
+}
+
+func TestLex(t *testing.T) {
+	text := "server_name 'a b' \"c\\\"d\"; # comment ;\nroot /x;"
+	want := []token{
+		{file: "f", line: 1, value: "server_name"},
+		{file: "f", line: 1, value: "a b", quote: true},
+		{file: "f", line: 1, value: `c"d`, quote: true},
+		{file: "f", line: 1, value: ";"},
+		{file: "f", line: 2, value: "root"},
+		{file: "f", line: 2, value: "/x"},
+		{file: "f", line: 2, value: ";"},
+	}
+
+	got, err := lex("f", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lex:\n got %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,290 @@
+// Package output writes the records of reporting tools in the format the
+// user asked for.
+//
+// A tool describes its records by named fields and hands every record to the
+// writer as a lookup function from field name to value. The user selects the
+// fields, their order and the format (csv, tsv, json, ndjson or table) on the
+// command line.
+package output
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// supported formats
+const (
+	FormatCSV    = "csv"
+	FormatTSV    = "tsv"
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatTable  = "table"
+)
+
+// supported timestamp formats
+const (
+	TimeRFC3339 = "rfc3339" // 2006-01-02T15:04:05Z
+	TimeEpoch   = "epoch"   // seconds since 1970
+	TimeMillis  = "ms"      // milliseconds since 1970, as used by the API
+)
+
+// Record returns the value of the named field of a single record.
+type Record func(field string) interface{}
+
+// Writer writes records with the selected fields in the selected format.
+type Writer struct {
+	Fields []string // selected fields in output order
+	Format string   // one of the Format constants
+	Header bool     // write a header line (csv and tsv only, tables always have one)
+	Time   string   // one of the Time constants
+
+	w       io.Writer
+	csv     *csv.Writer
+	table   *tabwriter.Writer
+	objects [][]byte // buffered objects of the json format
+	started bool
+}
+
+// Flags registers the output command line flags on the given flag set. The
+// tool passes all fields its records have and the fields selected by default.
+// The returned function must be called after the flags were parsed and builds
+// a writer to w.
+func Flags(fs *flag.FlagSet, fields []string, defaults string) func(w io.Writer) (*Writer, error) {
+	format := fs.String("format", FormatCSV, "output format: csv, tsv, json, ndjson or table")
+	header := fs.Bool("header", false, "write a header line with the field names (csv and tsv)")
+	selected := fs.String("fields", defaults, "comma separated fields to write, available: "+strings.Join(fields, ", "))
+	times := fs.String("time", TimeMillis, "timestamp format: rfc3339, epoch (seconds) or ms (milliseconds)")
+
+	return func(w io.Writer) (*Writer, error) {
+		known := make(map[string]bool)
+		for _, field := range fields {
+			known[field] = true
+		}
+
+		out := &Writer{
+			Format: *format,
+			Header: *header,
+			Time:   *times,
+			w:      w,
+		}
+		for _, field := range strings.Split(*selected, ",") {
+			field = strings.TrimSpace(field)
+			if !known[field] {
+				return nil, fmt.Errorf("unknown field %q, available: %s", field, strings.Join(fields, ", "))
+			}
+			out.Fields = append(out.Fields, field)
+		}
+
+		switch out.Time {
+		case TimeRFC3339, TimeEpoch, TimeMillis:
+		default:
+			return nil, fmt.Errorf("unknown time format %q, expected rfc3339, epoch or ms", out.Time)
+		}
+
+		switch out.Format {
+		case FormatCSV:
+			out.csv = csv.NewWriter(w)
+		case FormatTSV:
+			out.csv = csv.NewWriter(w)
+			out.csv.Comma = '\t'
+		case FormatTable:
+			out.table = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		case FormatJSON, FormatNDJSON:
+		default:
+			return nil, fmt.Errorf("unknown format %q, expected csv, tsv, json, ndjson or table", out.Format)
+		}
+
+		return out, nil
+	}
+}
+
+// Write writes a single record. Output is flushed per record except for the
+// json format and tables, which are written by Flush.
+func (w *Writer) Write(record Record) error {
+	if !w.started {
+		w.started = true
+		if err := w.header(); err != nil {
+			return err
+		}
+	}
+
+	switch w.Format {
+	case FormatJSON, FormatNDJSON:
+		object, err := w.object(record)
+		if err != nil {
+			return err
+		}
+		if w.Format == FormatJSON {
+			w.objects = append(w.objects, object)
+			return nil
+		}
+		_, err = w.w.Write(append(object, '\n'))
+		return err
+
+	case FormatTable:
+		values := make([]string, len(w.Fields))
+		for i, field := range w.Fields {
+			values[i] = w.text(record(field))
+		}
+		_, err := fmt.Fprintln(w.table, strings.Join(values, "\t"))
+		return err
+	}
+
+	// a list in the last field is expanded into one column per item, like
+	// the landing pages of an import file
+	values := []string{}
+	for i, field := range w.Fields {
+		value := record(field)
+		if list, ok := value.([]string); ok && i == len(w.Fields)-1 {
+			values = append(values, list...)
+			continue
+		}
+		values = append(values, w.text(value))
+	}
+
+	w.csv.Write(values)
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// Flush writes all buffered output. It must be called after the last record.
+func (w *Writer) Flush() error {
+	if !w.started {
+		w.started = true
+		if err := w.header(); err != nil {
+			return err
+		}
+	}
+
+	switch w.Format {
+	case FormatJSON:
+		var buf bytes.Buffer
+		buf.WriteString("[")
+		for i, object := range w.objects {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n\t")
+			buf.Write(object)
+		}
+		if len(w.objects) > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("]\n")
+		_, err := w.w.Write(buf.Bytes())
+		return err
+
+	case FormatTable:
+		return w.table.Flush()
+	}
+	return nil
+}
+
+// header writes the header line of the csv, tsv and table formats.
+func (w *Writer) header() error {
+	switch {
+	case w.Format == FormatTable:
+		upper := make([]string, len(w.Fields))
+		for i, field := range w.Fields {
+			upper[i] = strings.ToUpper(field)
+		}
+		_, err := fmt.Fprintln(w.table, strings.Join(upper, "\t"))
+		return err
+
+	case w.csv != nil && w.Header:
+		w.csv.Write(w.Fields)
+		w.csv.Flush()
+		return w.csv.Error()
+	}
+	return nil
+}
+
+// object encodes the record as JSON object with the fields in output order.
+func (w *Writer) object(record Record) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, field := range w.Fields {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+
+		key, _ := json.Marshal(field)
+		value, err := json.Marshal(w.value(record(field)))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", field, err)
+		}
+
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(value)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+// value converts timestamps to the selected time format; unset timestamps
+// become nil. All other values are returned as they are.
+func (w *Writer) value(v interface{}) interface{} {
+	var t time.Time
+	switch v := v.(type) {
+	case time.Time:
+		t = v
+	case nimbusec.Timestamp:
+		t = v.Time
+	default:
+		return v
+	}
+
+	if !IsSet(t) {
+		return nil
+	}
+
+	switch w.Time {
+	case TimeRFC3339:
+		return t.UTC().Format(time.RFC3339)
+	case TimeEpoch:
+		return t.Unix()
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// text formats a value for the csv, tsv and table formats. Lists are joined
+// by spaces.
+func (w *Writer) text(v interface{}) string {
+	switch v := w.value(v).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, " ")
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// IsSet reports whether the timestamp holds a date. The API reports missing
+// timestamps as null or as 0.
+func IsSet(t time.Time) bool {
+	return !t.IsZero() && t.Unix() > 0
+}
+
+// Millis converts a timestamp in milliseconds since 1970, as used by tokens
+// and results, to a time.
+func Millis(ms int) time.Time {
+	return time.Unix(int64(ms/1000), int64(ms%1000)*int64(time.Millisecond))
+}
@@ -0,0 +1,118 @@
+// Package quota checks whether bundles can take additional domains.
+//
+// Every bundle has a contingent of domains and a period it is valid for.
+// Tools reserve a slot for every domain they are about to add to a bundle
+// before the first domain is written, so a full or expired bundle is
+// reported up front instead of failing halfway through a run.
+package quota
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cumulodev/hoster-tools/internal/output"
+	"github.com/cumulodev/nimbusec"
+)
+
+// Usage is the usage of a single bundle.
+type Usage struct {
+	Bundle   nimbusec.Bundle
+	Reserved int // domains reserved in this run on top of the active ones
+}
+
+// Used returns the number of active and reserved domains.
+func (u *Usage) Used() int {
+	return u.Bundle.Active + u.Reserved
+}
+
+// Remaining returns the number of domains the bundle can still take. A
+// contingent of zero or less is treated as unlimited and reports -1.
+func (u *Usage) Remaining() int {
+	if u.Bundle.Contingent <= 0 {
+		return -1
+	}
+	if n := u.Bundle.Contingent - u.Used(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// Expired reports whether the bundle ended before now. Bundles without end
+// date never expire.
+func (u *Usage) Expired(now time.Time) bool {
+	return output.IsSet(u.Bundle.End.Time) && now.After(u.Bundle.End.Time)
+}
+
+// Pending reports whether the bundle only starts after now.
+func (u *Usage) Pending(now time.Time) bool {
+	return output.IsSet(u.Bundle.Start.Time) && now.Before(u.Bundle.Start.Time)
+}
+
+// check returns why the bundle can not take another domain, nil if it can.
+func (u *Usage) check(now time.Time) error {
+	switch {
+	case u.Expired(now):
+		return fmt.Errorf("bundle %s expired on %s", u.Bundle.Id, u.Bundle.End.Format("2006-01-02"))
+	case u.Pending(now):
+		return fmt.Errorf("bundle %s starts on %s", u.Bundle.Id, u.Bundle.Start.Format("2006-01-02"))
+	case u.Remaining() == 0:
+		return fmt.Errorf("bundle %s is full (%d of %d domains)", u.Bundle.Id, u.Used(), u.Bundle.Contingent)
+	}
+	return nil
+}
+
+// Tracker keeps the usage of all bundles of an account during a run.
+type Tracker struct {
+	now     time.Time
+	bundles map[string]*Usage
+}
+
+// New creates a tracker for the given bundles, checking validity periods
+// against now.
+func New(bundles []nimbusec.Bundle, now time.Time) *Tracker {
+	t := &Tracker{
+		now:     now,
+		bundles: make(map[string]*Usage),
+	}
+	for _, bundle := range bundles {
+		t.bundles[bundle.Id] = &Usage{Bundle: bundle}
+	}
+	return t
+}
+
+// Known reports whether the tracker knows the bundle.
+func (t *Tracker) Known(id string) bool {
+	_, ok := t.bundles[id]
+	return ok
+}
+
+// Reserve reserves a slot for one more domain in the bundle. It fails if the
+// bundle is unknown, full, expired or not yet started.
+func (t *Tracker) Reserve(id string) error {
+	usage, ok := t.bundles[id]
+	if !ok {
+		return fmt.Errorf("unknown bundle %s", id)
+	}
+	if err := usage.check(t.now); err != nil {
+		return err
+	}
+
+	usage.Reserved++
+	return nil
+}
+
+// Usages returns the usage of all bundles ordered by bundle name.
+func (t *Tracker) Usages() []*Usage {
+	list := make([]*Usage, 0, len(t.bundles))
+	for _, usage := range t.bundles {
+		list = append(list, usage)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bundle.Name != list[j].Bundle.Name {
+			return list[i].Bundle.Name < list[j].Bundle.Name
+		}
+		return list[i].Bundle.Id < list[j].Bundle.Id
+	})
+	return list
+}
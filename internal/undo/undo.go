@@ -0,0 +1,208 @@
+// Package undo saves everything needed to recreate a domain before it is
+// deleted.
+//
+// Deleting a domain also removes its configuration, the links to restricted
+// users and the notifications referencing it. Before each delete, tools
+// capture all of this into a record and append it to an undo file, one JSON
+// record per line. The restore tool recreates the domains from that file.
+package undo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// Record is everything needed to recreate a single deleted domain.
+type Record struct {
+	Deleted       time.Time         `json:"deleted"`       // time the record was captured, right before the delete
+	Domain        nimbusec.Domain   `json:"domain"`        // the domain as it was
+	Configs       map[string]string `json:"configs"`       // domain configuration by key
+	Users         []User            `json:"users"`         // restricted users the domain was linked to
+	Notifications []Notification    `json:"notifications"` // notifications referencing the domain
+}
+
+// User identifies a user linked to a domain. The login is used if the ID no
+// longer exists when restoring.
+type User struct {
+	Id    int    `json:"id"`
+	Login string `json:"login"`
+}
+
+// Notification is a notification of a user for the domain.
+type Notification struct {
+	User         User                  `json:"user"`
+	Notification nimbusec.Notification `json:"notification"`
+}
+
+// Log captures the records of domains about to be deleted and appends them
+// to an undo file. Users, their domain sets and their notifications are
+// fetched once, on the first capture. It is safe for concurrent use; a nil
+// Log saves nothing.
+type Log struct {
+	api *nimbusec.API
+
+	mu sync.Mutex // serializes writes to fh
+	fh *os.File
+
+	once          sync.Once
+	err           error
+	users         map[int][]User         // linked users by domain ID
+	notifications map[int][]Notification // notifications by domain ID
+}
+
+// Open opens the undo file at path for appending, creating it if needed. It
+// returns nil if path is empty.
+func Open(api *nimbusec.API, path string) (*Log, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{api: api, fh: fh}, nil
+}
+
+// Save captures the record of the domain and appends it to the undo file. The
+// record is synced to disk, so it survives even if the process dies right
+// after the delete. The domain must not be deleted if Save fails.
+func (l *Log) Save(domain nimbusec.Domain) error {
+	if l == nil {
+		return nil
+	}
+
+	record, err := l.capture(domain)
+	if err != nil {
+		return fmt.Errorf("undo record of %s: %v", domain.Name, err)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.fh.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return l.fh.Sync()
+}
+
+// Close closes the undo file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.fh.Close()
+}
+
+// load fetches the links and notifications of all users.
+func (l *Log) load() error {
+	users, err := l.api.FindUsers(nimbusec.EmptyFilter)
+	if err != nil {
+		return err
+	}
+
+	l.users = make(map[int][]User)
+	l.notifications = make(map[int][]Notification)
+	for _, user := range users {
+		ref := User{Id: user.Id, Login: user.Login}
+
+		// administrators can access all domains without links
+		if user.Role != nimbusec.RoleAdministrator {
+			set, err := l.api.GetDomainSet(&user)
+			if err != nil {
+				return fmt.Errorf("domains of user %s: %v", user.Login, err)
+			}
+			for _, id := range set {
+				l.users[id] = append(l.users[id], ref)
+			}
+		}
+
+		notifications, err := l.api.FindNotifications(user.Id, nimbusec.EmptyFilter)
+		if err != nil {
+			return fmt.Errorf("notifications of user %s: %v", user.Login, err)
+		}
+		for _, n := range notifications {
+			l.notifications[n.Domain] = append(l.notifications[n.Domain], Notification{User: ref, Notification: n})
+		}
+	}
+
+	return nil
+}
+
+// capture fetches the record of the domain.
+func (l *Log) capture(domain nimbusec.Domain) (*Record, error) {
+	l.once.Do(func() {
+		l.err = l.load()
+	})
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	// domains only known by ID and name are fetched completely
+	if domain.Bundle == "" {
+		full, err := l.api.GetDomain(domain.Id)
+		if err != nil {
+			return nil, err
+		}
+		domain = *full
+	}
+
+	keys, err := l.api.ListDomainConfigs(domain.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string]string)
+	for _, key := range keys {
+		value, err := l.api.GetDomainConfig(domain.Id, key)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %v", key, err)
+		}
+		configs[key] = value
+	}
+
+	return &Record{
+		Deleted:       time.Now().UTC(),
+		Domain:        domain,
+		Configs:       configs,
+		Users:         l.users[domain.Id],
+		Notifications: l.notifications[domain.Id],
+	}, nil
+}
+
+// Read loads all records of the undo file at path.
+func Read(path string) ([]Record, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	records := []Record{}
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid undo record: %v", path, line, err)
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
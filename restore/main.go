@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/cumulodev/goutils/pool"
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/exitcode"
+	"github.com/cumulodev/hoster-tools/internal/undo"
+	"github.com/cumulodev/nimbusec"
+)
+
+func main() {
+	url := flag.String("url", nimbusec.DefaultAPI, "API Url")
+	key := flag.String("key", "abc", "API key for authentication")
+	secret := flag.String("secret", "abc", "API secret for authentication")
+	file := flag.String("file", "undo.jsonl", "path to the undo file written by rm-domains or sync-domains")
+	only := flag.String("domains", "", "comma separated names of the domains to restore; all domains of the undo file if empty")
+	dryrun := flag.Bool("dry-run", false, "simulate what would be done without writing")
+	workers := flag.Int("workers", 1, "number of parallel workers (please do not use too many workers)")
+	configure := apiopts.Flags(flag.CommandLine)
+	flag.Parse()
+
+	records, err := undo.Read(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// a domain deleted more than once is restored as it was deleted last
+	latest := make(map[string]undo.Record)
+	order := []string{}
+	for _, record := range records {
+		name := record.Domain.Name
+		if _, ok := latest[name]; !ok {
+			order = append(order, name)
+		}
+		latest[name] = record
+	}
+
+	selected := order
+	if *only != "" {
+		selected = []string{}
+		for _, name := range strings.Split(*only, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := latest[name]; !ok {
+				log.Fatalf("domain %s is not in undo file %s", name, *file)
+			}
+			selected = append(selected, name)
+		}
+	}
+
+	// creates a new nimbusec API instance
+	api, err := apiopts.NewAPI(*url, *key, *secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configure(api)
+
+	// users are matched by ID and, if the ID no longer exists, by login
+	users, err := api.FindUsers(nimbusec.EmptyFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	byId := make(map[int]nimbusec.User)
+	byLogin := make(map[string]nimbusec.User)
+	for _, user := range users {
+		byId[user.Id] = user
+		byLogin[user.Login] = user
+	}
+
+	resolve := func(ref undo.User) (nimbusec.User, error) {
+		if user, ok := byId[ref.Id]; ok && user.Login == ref.Login {
+			return user, nil
+		}
+		if user, ok := byLogin[ref.Login]; ok {
+			return user, nil
+		}
+		return nimbusec.User{}, fmt.Errorf("user %s no longer exists", ref.Login)
+	}
+
+	pool := pool.New(*workers)
+	pool.Start()
+
+	failed := 0
+	for _, name := range selected {
+		pool.Add(&restoreJob{
+			api:     api,
+			record:  latest[name],
+			resolve: resolve,
+			dryrun:  *dryrun,
+			failed:  &failed,
+		})
+	}
+
+	pool.Wait()
+
+	fmt.Printf("restored %d of %d domains\n", len(selected)-failed, len(selected))
+	if failed > 0 {
+		os.Exit(exitcode.Partial)
+	}
+}
+
+// restoreJob recreates a single domain and relinks its users and
+// notifications. Restoring is idempotent, so a failed restore can simply be
+// repeated.
+type restoreJob struct {
+	api     *nimbusec.API
+	record  undo.Record
+	resolve func(undo.User) (nimbusec.User, error)
+	dryrun  bool
+	failed  *int
+
+	messages []string
+	err      error
+}
+
+func (job *restoreJob) Work() {
+	domain := job.record.Domain
+	domain.Id = 0
+
+	job.logf("restore domain: %s (deleted %s)", domain.Name, job.record.Deleted.Format("2006-01-02 15:04:05"))
+	if !job.dryrun {
+		created, err := job.api.CreateOrGetDomain(&domain)
+		if err != nil {
+			job.err = err
+			return
+		}
+		domain.Id = created.Id
+	}
+
+	for key, value := range job.record.Configs {
+		job.logf("\tset config %s", key)
+		if !job.dryrun {
+			if _, err := job.api.SetDomainConfig(domain.Id, key, value); err != nil {
+				job.err = fmt.Errorf("config %s: %v", key, err)
+				return
+			}
+		}
+	}
+
+	for _, ref := range job.record.Users {
+		user, err := job.resolve(ref)
+		if err != nil {
+			job.err = err
+			return
+		}
+
+		job.logf("\tlink user %s", user.Login)
+		if job.dryrun {
+			continue
+		}
+
+		set, err := job.api.GetDomainSet(&user)
+		if err != nil {
+			job.err = fmt.Errorf("domains of user %s: %v", user.Login, err)
+			return
+		}
+		if contains(set, domain.Id) {
+			continue
+		}
+		if err := job.api.LinkDomain(&user, domain.Id); err != nil {
+			job.err = fmt.Errorf("link user %s: %v", user.Login, err)
+			return
+		}
+	}
+
+	for _, n := range job.record.Notifications {
+		user, err := job.resolve(n.User)
+		if err != nil {
+			job.err = err
+			return
+		}
+
+		notification := n.Notification
+		notification.Id = 0
+		notification.Domain = domain.Id
+
+		job.logf("\tcreate %s notification for user %s", notification.Transport, user.Login)
+		if !job.dryrun {
+			if _, err := job.api.CreateOrGetNotification(user.Id, &notification); err != nil {
+				job.err = fmt.Errorf("notification of user %s: %v", user.Login, err)
+				return
+			}
+		}
+	}
+}
+
+func (job *restoreJob) logf(format string, args ...interface{}) {
+	job.messages = append(job.messages, fmt.Sprintf(format, args...))
+}
+
+func (job *restoreJob) Save() {
+	for _, msg := range job.messages {
+		fmt.Println(msg)
+	}
+	if job.err != nil {
+		*job.failed++
+		fmt.Printf("error: domain %s: %v\n", job.record.Domain.Name, job.err)
+	}
+}
+
+// contains reports whether id is in ids.
+func contains(ids []int, id int) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
-	"encoding/csv"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path"
+	"regexp"
+	"sort"
 
 	"github.com/cumulodev/goutils/pool"
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/archive"
+	"github.com/cumulodev/hoster-tools/internal/deletion"
+	"github.com/cumulodev/hoster-tools/internal/exitcode"
+	"github.com/cumulodev/hoster-tools/internal/guard"
+	"github.com/cumulodev/hoster-tools/internal/importcsv"
+	"github.com/cumulodev/hoster-tools/internal/undo"
 	"github.com/cumulodev/nimbusec"
 )
 
@@ -15,82 +24,178 @@ func main() {
 	url := flag.String("url", nimbusec.DefaultAPI, "API Url")
 	key := flag.String("key", "abc", "API key for authentication")
 	secret := flag.String("secret", "abc", "API secret for authentication")
-	file := flag.String("file", "delete.csv", "path to file with domains for deletion")
+	file := flag.String("file", "delete.csv", "path to file with domains for deletion (used if no other selection is given)")
+	stdin := flag.Bool("stdin", false, "read the names of the domains for deletion from stdin, one per line (with -file, only names in both lists are selected)")
+	filter := flag.String("filter", nimbusec.EmptyFilter, "select the domains matching this nimbusec filter expression")
+	glob := flag.String("glob", "", "select the domains whose name matches this shell pattern (e.g. *.example.com)")
+	pattern := flag.String("regex", "", "select the domains whose name matches this regular expression")
+	bundle := flag.String("bundle", "", "select the domains of this bundle ID")
+	keepData := flag.Bool("keep-data", false, "keep the results and other data of the deleted domains")
 	dryrun := flag.Bool("dry-run", false, "simulate what would be done without writing")
+	archivedir := flag.String("archive", "", "directory to archive the results and history of each domain to before it is deleted, see archive-domain")
+	undofile := flag.String("undo", "undo.jsonl", "path to the undo file the domains are saved to before they are deleted, see restore (empty to disable)")
+	guardFlags := guard.Flags(flag.CommandLine, "domains")
+	configure := apiopts.Flags(flag.CommandLine)
 
 	flag.Parse()
 
-	// creates a new nimbusec API instance
-	api, err := nimbusec.NewAPI(*url, *key, *secret)
+	limit, err := guardFlags()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// open csv input file and parse it
-	fh, err := os.Open(*file)
-	if err != nil {
-		log.Fatal(err)
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	sel := &selector{
+		glob:   *glob,
+		bundle: *bundle,
+	}
+	if _, err := path.Match(sel.glob, ""); err != nil {
+		log.Fatalf("invalid glob %q: %v", sel.glob, err)
+	}
+	if *pattern != "" {
+		if sel.regex, err = regexp.Compile(*pattern); err != nil {
+			log.Fatalf("invalid regex: %v", err)
+		}
+	}
+
+	// the CSV file stays the default selection
+	selected := *stdin || *filter != nimbusec.EmptyFilter || *glob != "" || *pattern != "" || *bundle != ""
+	if set["file"] || !selected {
+		// read and validate the csv input file
+		rows, err := importcsv.ReadDomainsFile(*file, importcsv.Options{})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		names := make([]string, len(rows))
+		for i, row := range rows {
+			names[i] = row.Name
+		}
+		sel.list(names)
+	}
+	if *stdin {
+		names, err := readNames(os.Stdin)
+		if err != nil {
+			log.Fatalf("stdin: %v", err)
+		}
+		sel.list(names)
 	}
 
-	defer fh.Close()
-	reader := csv.NewReader(fh)
-	reader.FieldsPerRecord = -1 // see the Reader struct information below
-	rows, err := reader.ReadAll()
+	// creates a new nimbusec API instance
+	api, err := apiopts.NewAPI(*url, *key, *secret)
 	if err != nil {
 		log.Fatal(err)
 	}
+	configure(api)
 
 	pool := pool.New(1)
 	pool.Start()
 
-	// keep track of domain names (required for delete step later)
-	ref := make(map[string]int)
-
+	// all domains are required for the guards
 	domains, err := api.FindDomains(nimbusec.EmptyFilter)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// map current domains
-	for _, domain := range domains {
-		ref[domain.Name] = domain.Id
+	candidates := domains
+	if *filter != nimbusec.EmptyFilter {
+		candidates, err = api.FindDomains(*filter)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	// check which domains can be deleted
-	rmcnt := 0
-	for _, row := range rows {
-		domainName := row[0]
-
-		if _, ok := ref[domainName]; ok {
-			rmcnt++
-			if *dryrun {
-				fmt.Printf("i would now delete '%s'\n", domainName)
-			} else {
-				pool.Add(deleteJob{
-					api: api,
-					domain: nimbusec.Domain{
-						Id:   ref[domainName],
-						Name: domainName,
-					},
-				})
-			}
+	obsolete := []nimbusec.Domain{}
+	for _, domain := range candidates {
+		if sel.match(domain) {
+			obsolete = append(obsolete, domain)
 		}
 	}
 
-	fmt.Printf("Deleted %d domains\n", rmcnt)
+	missing := sel.missing(domains)
+	sort.Strings(missing)
+	for _, name := range missing {
+		fmt.Printf("not found: %s\n", name)
+	}
+
+	if *dryrun {
+		for _, domain := range obsolete {
+			fmt.Printf("i would now delete '%s'\n", domain.Name)
+		}
+	}
+
+	// abort before the first delete if one of the guards trips
+	names := make([]string, len(obsolete))
+	for i, domain := range obsolete {
+		names[i] = domain.Name
+	}
+	if err := limit.Check(names, len(domains)); err != nil {
+		log.Fatal(err)
+	}
+
+	if *dryrun {
+		return
+	}
+
+	undoLog, err := undo.Open(api, *undofile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	archiver, err := archive.New(api, *archivedir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleter := deletion.New(api, archiver, undoLog)
+	deleted, failed := 0, 0
+	for _, domain := range obsolete {
+		pool.Add(&deleteJob{
+			deleter: deleter,
+			domain:  domain,
+			clean:   !*keepData,
+			deleted: &deleted,
+			failed:  &failed,
+		})
+	}
 
 	pool.Wait()
+	if err := undoLog.Close(); err != nil {
+		log.Printf("failed to close undo file: %v", err)
+	}
 
+	fmt.Printf("deleted %d of %d domains, %d failed\n", deleted, len(obsolete), failed)
+	if failed > 0 {
+		os.Exit(exitcode.Partial)
+	}
 }
 
 type deleteJob struct {
-	api    *nimbusec.API
-	domain nimbusec.Domain
+	deleter *deletion.Deleter
+	domain  nimbusec.Domain
+	clean   bool // remove all results and other data of the domain
+	deleted *int
+	failed  *int
+
+	err error
 }
 
-func (job deleteJob) Work() {
-	fmt.Printf("delete domain: %s\n", job.domain.Name)
-	job.api.DeleteDomain(&job.domain, true)
+func (job *deleteJob) Work() {
+	job.err = job.deleter.Delete(job.domain, job.clean)
 }
 
-func (job deleteJob) Save() {}
+func (job *deleteJob) Save() {
+	if job.err != nil {
+		*job.failed++
+		fmt.Printf("failed: %s: %v\n", job.domain.Name, job.err)
+		return
+	}
+
+	*job.deleted++
+	fmt.Printf("deleted: %s\n", job.domain.Name)
+}
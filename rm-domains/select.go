@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// selector narrows the domains of the account down to the ones to delete.
+// All criteria that are set must match.
+type selector struct {
+	names  map[string]bool // names listed in the CSV file or on stdin, nil if no list is given
+	glob   string          // shell pattern on the name
+	regex  *regexp.Regexp  // regular expression on the name
+	bundle string          // bundle ID
+}
+
+// match reports whether the domain is selected.
+func (s *selector) match(domain nimbusec.Domain) bool {
+	if s.names != nil && !s.names[domain.Name] {
+		return false
+	}
+	if s.glob != "" {
+		// the pattern was validated when the flags were parsed
+		if ok, _ := path.Match(s.glob, domain.Name); !ok {
+			return false
+		}
+	}
+	if s.regex != nil && !s.regex.MatchString(domain.Name) {
+		return false
+	}
+	if s.bundle != "" && domain.Bundle != s.bundle {
+		return false
+	}
+	return true
+}
+
+// list restricts the selection to the given names. Like all criteria, a
+// second list must match as well, so only names in both lists are selected.
+func (s *selector) list(names []string) {
+	listed := make(map[string]bool)
+	for _, name := range names {
+		if s.names == nil || s.names[name] {
+			listed[name] = true
+		}
+	}
+	s.names = listed
+}
+
+// missing returns the listed names that are not in the given domains.
+func (s *selector) missing(domains []nimbusec.Domain) []string {
+	known := make(map[string]bool)
+	for _, domain := range domains {
+		known[domain.Name] = true
+	}
+
+	list := []string{}
+	for name := range s.names {
+		if !known[name] {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// readNames reads domain names, one per line. Empty lines and lines starting
+// with # are ignored.
+func readNames(r io.Reader) ([]string, error) {
+	names := []string{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		if strings.ContainsAny(name, " \t,") {
+			return nil, fmt.Errorf("line %d: invalid domain name %q", line, name)
+		}
+		names = append(names, name)
+	}
+	return names, scanner.Err()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cumulodev/hoster-tools/internal/quota"
+	"github.com/cumulodev/nimbusec"
+)
+
+// allocate reserves a bundle slot for every desired domain that is new or,
+// with update, moves to another bundle. Domains whose bundle can not take
+// them are moved to the fallback bundle if one is given. The returned error
+// lists all domains that fit nowhere; nothing must be written in that case.
+//
+// Deletions are not credited, they only run after all creates and updates.
+func allocate(desired, remote []nimbusec.Domain, bundles []nimbusec.Bundle, fallback string, update bool) error {
+	tracker := quota.New(bundles, time.Now())
+	if fallback != "" && !tracker.Known(fallback) {
+		return fmt.Errorf("unknown fallback bundle %s", fallback)
+	}
+
+	existing := make(map[string]nimbusec.Domain)
+	for _, domain := range remote {
+		existing[domain.Name] = domain
+	}
+
+	// domains that fit nowhere, grouped by reason
+	reasons := []string{}
+	refused := make(map[string][]string)
+
+	for i, domain := range desired {
+		current, ok := existing[domain.Name]
+		if ok && (!update || current.Bundle == domain.Bundle) {
+			continue
+		}
+
+		err := tracker.Reserve(domain.Bundle)
+		if err == nil {
+			continue
+		}
+
+		if fallback != "" && fallback != domain.Bundle {
+			// spilled over by an earlier run, stays where it is
+			if ok && current.Bundle == fallback {
+				desired[i].Bundle = fallback
+				continue
+			}
+
+			if tracker.Reserve(fallback) == nil {
+				log.Printf("%s: %v, using fallback bundle %s", domain.Name, err, fallback)
+				desired[i].Bundle = fallback
+				continue
+			}
+		}
+
+		reason := err.Error()
+		if _, ok := refused[reason]; !ok {
+			reasons = append(reasons, reason)
+		}
+		refused[reason] = append(refused[reason], domain.Name)
+	}
+
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	lines := []string{"bundles can not take all domains:"}
+	for _, reason := range reasons {
+		lines = append(lines, fmt.Sprintf("%s: %d domains (%s)", reason, len(refused[reason]), strings.Join(refused[reason], ", ")))
+	}
+	return errors.New(strings.Join(lines, "\n"))
+}
+
+// changedDomains returns the domains a plan creates or updates.
+func changedDomains(plan *Plan) []nimbusec.Domain {
+	list := []nimbusec.Domain{}
+	for _, change := range plan.Changes {
+		if change.Action == actionCreate || change.Action == actionUpdate {
+			list = append(list, change.Domain)
+		}
+	}
+	return list
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// Journal records every completed operation of a run as soon as it is done,
+// so an interrupted run can be resumed without repeating them. The first line
+// of the journal file describes the run, every further line is an operation.
+type Journal struct {
+	path   string
+	fh     *os.File
+	header JournalHeader
+	done   map[string]bool
+
+	resumed bool // whether an interrupted run is continued
+}
+
+// JournalHeader identifies the run a journal belongs to.
+type JournalHeader struct {
+	Started time.Time `json:"started"` // start of the interrupted run
+	Mode    string    `json:"mode"`    // mode of the run
+	Input   string    `json:"input"`   // import file, Apache configuration or plan
+	Digest  string    `json:"digest"`  // hash of the input file, empty for directories
+}
+
+// JournalEntry is a single completed operation.
+type JournalEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Domain string    `json:"domain"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// openJournal creates the journal at path. With resume, the operations of an
+// existing journal are loaded and further operations are appended; the
+// journal must belong to a run with the same mode and input. A missing
+// journal simply starts a new run.
+func openJournal(path string, resume bool, header JournalHeader) (*Journal, error) {
+	j := &Journal{
+		path:   path,
+		header: header,
+		done:   make(map[string]bool),
+	}
+
+	if resume {
+		previous, err := j.load()
+		switch {
+		case os.IsNotExist(err):
+			log.Printf("no journal %s to resume, starting a new run", path)
+		case err != nil:
+			return nil, err
+		case previous.Mode != header.Mode || previous.Input != header.Input || previous.Digest != header.Digest:
+			return nil, fmt.Errorf("journal %s belongs to a %s run of %s started at %s; remove it to start a new run",
+				path, previous.Mode, previous.Input, previous.Started.Format(time.RFC3339))
+		default:
+			log.Printf("resuming run started at %s, skipping %d completed operations", previous.Started.Format(time.RFC3339), len(j.done))
+			j.header = previous
+			j.resumed = true
+
+			fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, err
+			}
+			j.fh = fh
+			return j, nil
+		}
+	} else if _, err := os.Stat(path); err == nil {
+		log.Printf("journal %s of an interrupted run exists, starting over (use -resume to continue it)", path)
+	}
+
+	fh, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	j.fh = fh
+
+	if err := j.write(header); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// load reads the header and the successful operations of the journal file.
+func (j *Journal) load() (JournalHeader, error) {
+	var header JournalHeader
+
+	fh, err := os.Open(j.path)
+	if err != nil {
+		return header, err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		if line == 1 {
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				return header, fmt.Errorf("invalid journal %s: %v", j.path, err)
+			}
+			continue
+		}
+
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last line may be incomplete if the process was killed
+			// while writing it
+			log.Printf("%s:%d: ignoring invalid journal entry", j.path, line)
+			continue
+		}
+		if entry.Error == "" {
+			j.done[entry.Action+" "+entry.Domain] = true
+		}
+	}
+
+	return header, scanner.Err()
+}
+
+// Done reports whether the operation completed successfully in the run that
+// is resumed.
+func (j *Journal) Done(action, domain string) bool {
+	return j != nil && j.done[action+" "+domain]
+}
+
+// Record appends a completed operation and syncs it to disk.
+func (j *Journal) Record(action, domain, result string, err error) error {
+	if j == nil {
+		return nil
+	}
+
+	entry := JournalEntry{
+		Time:   time.Now().UTC(),
+		Action: action,
+		Domain: domain,
+		Result: result,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return j.write(entry)
+}
+
+func (j *Journal) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.fh.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.fh.Sync()
+}
+
+// Close closes the journal. The journal of a complete run is removed, only
+// interrupted runs need to be resumed.
+func (j *Journal) Close(complete bool) error {
+	if j == nil {
+		return nil
+	}
+
+	if err := j.fh.Close(); err != nil {
+		return err
+	}
+	if complete {
+		return os.Remove(j.path)
+	}
+	return nil
+}
+
+// digest hashes the content of the file at path. Directories and unreadable
+// files yield an empty digest.
+func digest(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// startJournal opens the journal for a run of mode on input. It returns nil
+// if no journal path is configured.
+func startJournal(path string, resume bool, mode, input string) (*Journal, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	return openJournal(path, resume, JournalHeader{
+		Started: time.Now().UTC(),
+		Mode:    mode,
+		Input:   input,
+		Digest:  digest(input),
+	})
+}
+
+// Resumed reports whether the journal continues an interrupted run.
+func (j *Journal) Resumed() bool {
+	return j != nil && j.resumed
+}
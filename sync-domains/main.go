@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/csv"
 	"flag"
 	"fmt"
 	"log"
@@ -9,6 +8,14 @@ import (
 	"time"
 
 	"github.com/cumulodev/goutils/pool"
+	"github.com/cumulodev/hoster-tools/internal/apacheconf"
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/archive"
+	"github.com/cumulodev/hoster-tools/internal/deletion"
+	"github.com/cumulodev/hoster-tools/internal/guard"
+	"github.com/cumulodev/hoster-tools/internal/importcsv"
+	"github.com/cumulodev/hoster-tools/internal/interrupt"
+	"github.com/cumulodev/hoster-tools/internal/undo"
 	"github.com/cumulodev/nimbusec"
 )
 
@@ -17,135 +24,566 @@ func main() {
 	key := flag.String("key", "abc", "API key for authentication")
 	secret := flag.String("secret", "abc", "API secret for authentication")
 	file := flag.String("file", "import.csv", "path to import file")
+	apache := flag.String("apache", "", "read the domains from this Apache configuration file or directory instead of the import file")
+	aliases := flag.Bool("apache-aliases", false, "register each ServerAlias of an Apache virtual host as domain of its own")
+	bundle := flag.String("bundle", "", "bundle ID of the domains read from the Apache configuration")
+	fallback := flag.String("fallback-bundle", "", "bundle ID for new domains whose bundle is full or expired; without it such a sync is refused")
 	delete := flag.Bool("delete", false, "delete domains from nimbusec if not provided in the CSV")
 	update := flag.Bool("update", false, "updates domain info; false to just insert new domains")
 	workers := flag.Int("workers", 1, "number of parallel workers (please do not use too many workers)")
-	throttle := flag.Int("throttle", 0, "delay in seconds per domain creation")
+	throttle := flag.Int("throttle", 0, "deprecated: limit API requests to one per given seconds, use -rate instead")
+	mode := flag.String("mode", "sync", "sync to write immediately, incremental to only write rows changed since the last run, plan to only write the change plan, apply to execute a saved plan")
+	statefile := flag.String("state", "", "path to the state file remembering synced rows; required in incremental mode, written by sync and incremental mode")
+	planfile := flag.String("plan", "plan.json", "path to the change plan written in plan mode and read in apply mode")
+	reportfile := flag.String("report", "", "path to write a JSON report of all domain outcomes to")
+	journalfile := flag.String("journal", "", "path to the journal recording every completed operation of a sync or apply run")
+	resume := flag.Bool("resume", false, "continue the interrupted run recorded in the journal")
+	archivedir := flag.String("archive", "", "directory to archive the results and history of each domain to before it is deleted, see archive-domain")
+	undofile := flag.String("undo", "undo.jsonl", "path to the undo file domains are saved to before they are deleted, see restore (empty to disable)")
+	guardFlags := guard.Flags(flag.CommandLine, "domains")
+	configure := apiopts.Flags(flag.CommandLine)
 	flag.Parse()
 
-	waitdur := time.Duration(*throttle) * time.Second
-
-	// creates a new nimbusec API instance
-	api, err := nimbusec.NewAPI(*url, *key, *secret)
+	limit, err := guardFlags()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// open csv input file and parse it
-	fh, err := os.Open(*file)
-	if err != nil {
-		log.Fatal(err)
+	if *resume && *journalfile == "" {
+		log.Fatal("resume requires a journal, see -journal")
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if *throttle > 0 && (set["rate"] || set["burst"]) {
+		log.Fatal("throttle can not be combined with rate or burst, please use rate only")
 	}
 
-	defer fh.Close()
-	reader := csv.NewReader(fh)
-	reader.FieldsPerRecord = -1 // see the Reader struct information below
-	rows, err := reader.ReadAll()
+	// creates a new nimbusec API instance
+	api, err := apiopts.NewAPI(*url, *key, *secret)
 	if err != nil {
 		log.Fatal(err)
 	}
+	configure(api)
+	if *throttle > 0 {
+		apiopts.SetRateLimit(api, 1/float64(*throttle), 1)
+	}
 
 	pool := pool.New(*workers)
 	pool.Start()
 
-	// keep track of domain names (required for delete step later)
-	ref := make(map[string]bool)
-
-	for _, row := range rows {
-		name := row[0]
-		scheme := row[2]
-		bundle := row[3]
-
-		url := scheme + "://" + name
-		//		if len(row) > 4 {
-		//			deeplink := row[4]
-		//			if deeplink == "" {
-		//				// do nothing
-		//			} else if strings.HasPrefix(deeplink, "/") {
-		//				url = url + deeplink
-		//			} else {
-		//				url = deeplink
-		//			}
-		//		}
-
-		// construct domain
-		domain := &nimbusec.Domain{
-			Name:      name,
-			Bundle:    bundle,
-			Scheme:    scheme,
-			DeepScan:  url,
-			FastScans: []string{url},
-		}
-
-		// upsert domain
-		ref[name] = true
-		pool.Add(upsertJob{
-			api:      api,
-			domain:   *domain,
-			update:   *update,
-			throttle: waitdur,
-		})
-	}
-
-	pool.Wait()
-
-	// sync
-	// delete domains not listed in new set
-	if *delete {
+	report := NewReport()
+	stop := interrupt.Notify()
+	var journal *Journal
+
+	archiver, err := archive.New(api, *archivedir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the undo file is opened on the first delete
+	var (
+		undoLog *undo.Log
+		deleter *deletion.Deleter
+	)
+	newDeleter := func() *deletion.Deleter {
+		if deleter == nil {
+			if undoLog, err = undo.Open(api, *undofile); err != nil {
+				log.Fatal(err)
+			}
+			deleter = deletion.New(api, archiver, undoLog)
+		}
+		return deleter
+	}
+
+	src := source{
+		file:    *file,
+		apache:  *apache,
+		aliases: *aliases,
+		bundle:  *bundle,
+	}
+
+	switch *mode {
+	case "sync", "incremental":
+		desired, keep, bundles, err := readDomains(api, src)
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		// read all domains from api
 		domains, err := api.FindDomains(nimbusec.EmptyFilter)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		// cross reference domains in nimbusec with csv file and delete all
-		// domains not present in csv file
+		existing := make(map[string]nimbusec.Domain)
 		for _, domain := range domains {
-			if !ref[domain.Name] {
-				pool.Add(deleteJob{
+			existing[domain.Name] = domain
+		}
+
+		// keep track of domain names (required for delete step later)
+		ref := make(map[string]bool)
+		for _, domain := range desired {
+			ref[domain.Name] = true
+		}
+
+		// hash the rows as read, before bundles may be replaced by the
+		// fallback bundle
+		hashes := make(map[string]string)
+		for _, domain := range desired {
+			hashes[domain.Name] = rowHash(domain)
+		}
+		keepFastScans(desired, keep, domains)
+
+		var state *State
+		if *statefile != "" {
+			state = NewState()
+		}
+
+		pending := desired
+		if *mode == "incremental" {
+			if *statefile == "" {
+				log.Fatal("incremental mode requires a state file, see -state")
+			}
+
+			previous, ok, err := readState(*statefile)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			mismatches := previous.Mismatches(domains, ref)
+			switch {
+			case !ok:
+				log.Printf("no state file %s yet, running a full sync", *statefile)
+			case len(mismatches) > 0:
+				log.Printf("state file %s does not match the remote domains, running a full sync:", *statefile)
+				for i, mismatch := range mismatches {
+					if i == 10 {
+						log.Printf("\t... and %d more", len(mismatches)-i)
+						break
+					}
+					log.Printf("\t%s", mismatch)
+				}
+			default:
+				state = previous
+				pending = []nimbusec.Domain{}
+				for _, domain := range desired {
+					if state.Changed(domain.Name, hashes[domain.Name]) {
+						pending = append(pending, domain)
+					}
+				}
+				log.Printf("%d of %d rows changed since %s", len(pending), len(desired), state.Updated.Format(time.RFC3339))
+			}
+		}
+
+		// check the bundle capacity before anything is written
+		if err := allocate(pending, domains, bundles, *fallback, *update); err != nil {
+			log.Fatal(err)
+		}
+
+		// cross reference domains in nimbusec with csv file and find all
+		// domains not present in csv file
+		obsolete := []nimbusec.Domain{}
+		if *delete {
+			for _, domain := range domains {
+				if !ref[domain.Name] {
+					obsolete = append(obsolete, domain)
+				}
+			}
+
+			// check the guards before anything is written
+			if err := limit.Check(names(obsolete), len(domains)); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		journal, err = startJournal(*journalfile, *resume, *mode, src.String())
+		if err != nil {
+			log.Fatal(err)
+		}
+		report.journal = journal
+
+		for _, domain := range pending {
+			// stop dispatching on SIGINT or SIGTERM, running jobs finish
+			if stop.Stopped() {
+				break
+			}
+
+			var current *nimbusec.Domain
+			if remote, ok := existing[domain.Name]; ok {
+				current = &remote
+			}
+
+			// the fresh state must still know the rows synced before the
+			// interruption
+			if journal.Done(actionUpsert, domain.Name) {
+				state.Resume(domain, hashes[domain.Name], current, *update)
+				continue
+			}
+
+			// upsert domain
+			pool.Add(&upsertJob{
+				api:      api,
+				report:   report,
+				state:    state,
+				hash:     hashes[domain.Name],
+				domain:   domain,
+				existing: current,
+				update:   *update,
+			})
+		}
+
+		pool.Wait()
+
+		// sync
+		// delete domains not listed in new set
+		for _, domain := range obsolete {
+			if stop.Stopped() {
+				break
+			}
+			if journal.Done(actionDelete, domain.Name) {
+				continue
+			}
+
+			pool.Add(&deleteJob{
+				deleter: newDeleter(),
+				report:  report,
+				state:   state,
+				domain:  domain,
+			})
+		}
+
+		pool.Wait()
+
+		if state != nil {
+			state.Retain(ref)
+			state.Updated = time.Now().UTC()
+			state.Source = src.String()
+			if err := writeState(*statefile, state); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+	case "plan":
+		desired, keep, bundles, err := readDomains(api, src)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		remote, err := api.FindDomains(nimbusec.EmptyFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keepFastScans(desired, keep, remote)
+
+		// the plan already contains the fallback bundles
+		if err := allocate(desired, remote, bundles, *fallback, *update); err != nil {
+			log.Fatal(err)
+		}
+
+		plan := makePlan(desired, remote, *update, *delete)
+		plan.Source = src.String()
+		if err := writePlan(*planfile, plan); err != nil {
+			log.Fatal(err)
+		}
+
+		printPlan(plan)
+		fmt.Printf("plan written to %s\n", *planfile)
+
+		// warn early, apply will refuse the plan with the same guards
+		if err := limit.Check(plan.Deletions(), len(remote)); err != nil {
+			fmt.Printf("warning: %v\n", err)
+		}
+		return
+
+	case "apply":
+		plan, err := readPlan(*planfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		journal, err = startJournal(*journalfile, *resume, *mode, *planfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report.journal = journal
+
+		// refuse to apply a stale plan; the diff would no longer describe
+		// what actually happens. A resumed plan already changed the remote
+		// domains, the journal tells which of its changes are done.
+		remote, err := api.FindDomains(nimbusec.EmptyFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !journal.Resumed() && fingerprint(remote) != plan.Remote {
+			log.Fatalf("remote domains changed since plan %s was made at %s; please create a new plan",
+				*planfile, plan.Created.Format(time.RFC3339))
+		}
+
+		if err := limit.Check(plan.Deletions(), len(remote)); err != nil {
+			log.Fatal(err)
+		}
+
+		// bundles may have filled up or expired since the plan was made;
+		// a reviewed plan is never changed, so there is no fallback here
+		bundles, err := api.FindBundles(nimbusec.EmptyFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := allocate(changedDomains(plan), remote, bundles, "", true); err != nil {
+			log.Fatal(err)
+		}
+
+		for _, change := range plan.Changes {
+			if stop.Stopped() {
+				break
+			}
+			if journal.Done(change.Action, change.Domain.Name) {
+				continue
+			}
+
+			if change.Action == actionDelete {
+				pool.Add(&deleteJob{
+					deleter: newDeleter(),
+					report:  report,
+					domain:  change.Domain,
+				})
+			} else {
+				pool.Add(&applyJob{
 					api:    api,
-					domain: domain,
+					report: report,
+					change: change,
 				})
 			}
 		}
 
 		pool.Wait()
+
+	default:
+		log.Fatalf("unknown mode %q, expected sync, incremental, plan or apply", *mode)
+	}
+
+	report.Finished = time.Now().UTC()
+	report.Interrupted = stop.Stopped()
+	if err := undoLog.Close(); err != nil {
+		log.Printf("failed to close undo file: %v", err)
+	}
+	if err := journal.Close(!report.Interrupted); err != nil {
+		log.Printf("failed to close journal: %v", err)
+	}
+	if report.Interrupted && journal != nil {
+		log.Printf("run interrupted, continue it with -journal %s -resume", *journalfile)
+	}
+
+	fmt.Println()
+	report.Print(os.Stdout)
+	if *reportfile != "" {
+		if err := report.Write(*reportfile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	os.Exit(report.ExitCode())
+}
+
+// names returns the names of the given domains.
+func names(domains []nimbusec.Domain) []string {
+	list := make([]string, len(domains))
+	for i, domain := range domains {
+		list[i] = domain.Name
+	}
+	return list
+}
+
+// source describes where the desired domains are read from.
+type source struct {
+	file    string // import CSV file
+	apache  string // Apache configuration, replaces the import file if set
+	aliases bool   // register server aliases as domains
+	bundle  string // bundle of domains read from the Apache configuration
+}
+
+func (src source) String() string {
+	if src.apache != "" {
+		return src.apache
+	}
+	return src.file
+}
+
+// records reads and validates the domain records of the source.
+func (src source) records() ([]importcsv.Domain, error) {
+	opts := importcsv.Options{Register: true}
+	if src.apache == "" {
+		return importcsv.ReadDomainsFile(src.file, opts)
+	}
+
+	vhosts, err := apacheconf.Parse(src.apache)
+	if err != nil {
+		return nil, err
+	}
+
+	records, skipped := apacheconf.Domains(vhosts, src.aliases, src.bundle)
+	for _, name := range skipped {
+		log.Printf("skipping wildcard name %s", name)
+	}
+
+	if err := importcsv.Validate(records, opts); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// readDomains reads and validates the desired domains and checks that all
+// referenced bundles exist. Problems in the source are reported before the API
+// is called at all. Along with the domains, the names of the domains whose
+// registered landing pages are kept (see keepFastScans) and the bundles of
+// the account are returned.
+func readDomains(api *nimbusec.API, src source) ([]nimbusec.Domain, map[string]bool, []nimbusec.Bundle, error) {
+	records, err := src.records()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	bundles, err := api.FindBundles(nimbusec.EmptyFilter)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := importcsv.CheckBundles(records, bundles); err != nil {
+		return nil, nil, nil, err
+	}
+
+	domains := make([]nimbusec.Domain, len(records))
+	keep := make(map[string]bool)
+	for i, record := range records {
+		// already validated while reading
+		domains[i], _ = record.Nimbusec()
+		if record.KeepFastScans {
+			keep[record.Name] = true
+		}
+	}
+
+	return domains, keep, bundles, nil
+}
+
+// keepFastScans adds the landing pages of the registered domains to the
+// desired domains whose import file has no fast scan column, so an import
+// file written by get-domains with its default columns does not remove them.
+func keepFastScans(desired []nimbusec.Domain, keep map[string]bool, remote []nimbusec.Domain) {
+	registered := make(map[string]nimbusec.Domain)
+	for _, domain := range remote {
+		registered[domain.Name] = domain
+	}
+
+	for i, domain := range desired {
+		if current, ok := registered[domain.Name]; ok && keep[domain.Name] {
+			desired[i] = importcsv.MergeFastScans(domain, current)
+		}
 	}
 }
 
 type upsertJob struct {
 	api      *nimbusec.API
+	report   *Report
+	state    *State // nil if no state is kept
+	hash     string // hash of the import row
 	domain   nimbusec.Domain
+	existing *nimbusec.Domain // remote domain before the upsert, nil if new
 	update   bool
-	throttle time.Duration
+
+	id     int  // ID of the remote domain after the upsert
+	synced bool // whether the remote domain matches the import row
+	result string
+	err    error
 }
 
-func (job upsertJob) Work() {
+func (job *upsertJob) Work() {
 	fmt.Printf("upsert domain: %+v\n", job.domain)
+	var domain *nimbusec.Domain
 	if job.update {
-		if _, err := job.api.CreateOrUpdateDomain(&job.domain); err != nil {
-			log.Fatal(err)
-		}
+		domain, job.err = job.api.CreateOrUpdateDomain(&job.domain)
 	} else {
-		if _, err := job.api.CreateOrGetDomain(&job.domain); err != nil {
-			log.Fatal(err)
-		}
+		domain, job.err = job.api.CreateOrGetDomain(&job.domain)
 	}
-	if job.throttle > 0 {
-		time.Sleep(job.throttle)
+
+	switch {
+	case job.err != nil:
+		// recorded as failed by Save
+		return
+	case job.existing == nil:
+		job.result = resultCreated
+	case len(diffDomain(*job.existing, *domain)) > 0:
+		job.result = resultUpdated
+	default:
+		job.result = resultUnchanged
 	}
+
+	// without update, an existing domain keeps its remote values
+	job.id = domain.Id
+	job.synced = job.update || job.existing == nil || len(diffDomain(*job.existing, job.domain)) == 0
 }
 
-func (job upsertJob) Save() {}
+func (job *upsertJob) Save() {
+	job.report.Add(job.domain.Name, actionUpsert, job.result, job.err)
+	if job.state == nil {
+		return
+	}
 
-type deleteJob struct {
+	// rows not synced are sent again by the next incremental run
+	switch {
+	case job.synced:
+		job.state.Domains[job.domain.Name] = Entry{Hash: job.hash, Id: job.id}
+	case job.existing != nil:
+		job.state.Domains[job.domain.Name] = Entry{Id: job.existing.Id}
+	default:
+		delete(job.state.Domains, job.domain.Name)
+	}
+}
+
+// applyJob executes a create or update change of a saved plan.
+type applyJob struct {
 	api    *nimbusec.API
-	domain nimbusec.Domain
+	report *Report
+	change Change
+
+	err error
 }
 
-func (job deleteJob) Work() {
+func (job *applyJob) Work() {
+	fmt.Printf("%s domain: %+v\n", job.change.Action, job.change.Domain)
+	if job.change.Action == actionUpdate {
+		_, job.err = job.api.UpdateDomain(&job.change.Domain)
+	} else {
+		_, job.err = job.api.CreateDomain(&job.change.Domain)
+	}
+}
+
+func (job *applyJob) Save() {
+	result := resultCreated
+	if job.change.Action == actionUpdate {
+		result = resultUpdated
+	}
+	job.report.Add(job.change.Domain.Name, job.change.Action, result, job.err)
+}
+
+type deleteJob struct {
+	deleter *deletion.Deleter
+	report  *Report
+	state   *State // nil if no state is kept
+	domain  nimbusec.Domain
+
+	err error
+}
+
+func (job *deleteJob) Work() {
 	fmt.Printf("delete domain: %s\n", job.domain.Name)
-	job.api.DeleteDomain(&job.domain, true)
+	job.err = job.deleter.Delete(job.domain, true)
 }
 
-func (job deleteJob) Save() {}
+func (job *deleteJob) Save() {
+	job.report.Add(job.domain.Name, actionDelete, resultDeleted, job.err)
+	if job.state != nil && job.err == nil {
+		delete(job.state.Domains, job.domain.Name)
+	}
+}
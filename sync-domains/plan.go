@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+const (
+	actionCreate = "create"
+	actionUpdate = "update"
+	actionUpsert = "upsert"
+	actionDelete = "delete"
+)
+
+// Plan is the reviewable set of changes sync-domains would apply to the
+// nimbusec account. It is written in plan mode and executed in apply mode.
+type Plan struct {
+	Created time.Time `json:"created"` // time the plan was made
+	Source  string    `json:"source"`  // import file the plan was computed from
+	Remote  string    `json:"remote"`  // fingerprint of the remote domains at plan time
+	Changes []Change  `json:"changes"` // all changes in the order they will be applied
+}
+
+// Change is a single create, update or delete of a domain.
+type Change struct {
+	Action string          `json:"action"`           // one of create, update or delete
+	Domain nimbusec.Domain `json:"domain"`           // desired domain (or remote domain for deletes)
+	Fields []FieldChange   `json:"fields,omitempty"` // field level changes of an update
+}
+
+// FieldChange describes the before and after value of a single domain field.
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Count returns the number of changes with the given action.
+func (p *Plan) Count(action string) int {
+	n := 0
+	for _, change := range p.Changes {
+		if change.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// Deletions returns the names of all domains the plan deletes.
+func (p *Plan) Deletions() []string {
+	list := []string{}
+	for _, change := range p.Changes {
+		if change.Action == actionDelete {
+			list = append(list, change.Domain.Name)
+		}
+	}
+	return list
+}
+
+// makePlan diffs the desired domains from the import file against the remote
+// domains. Existing domains are only updated if update is set and remote
+// domains missing in the import are only deleted if delete is set.
+func makePlan(desired, remote []nimbusec.Domain, update, delete bool) *Plan {
+	plan := &Plan{
+		Created: time.Now().UTC(),
+		Remote:  fingerprint(remote),
+		Changes: []Change{},
+	}
+
+	existing := make(map[string]nimbusec.Domain)
+	for _, domain := range remote {
+		existing[domain.Name] = domain
+	}
+
+	ref := make(map[string]bool)
+	for _, domain := range desired {
+		ref[domain.Name] = true
+
+		current, ok := existing[domain.Name]
+		if !ok {
+			plan.Changes = append(plan.Changes, Change{
+				Action: actionCreate,
+				Domain: domain,
+			})
+			continue
+		}
+
+		if !update {
+			continue
+		}
+
+		fields := diffDomain(current, domain)
+		if len(fields) == 0 {
+			continue
+		}
+
+		domain.Id = current.Id
+		plan.Changes = append(plan.Changes, Change{
+			Action: actionUpdate,
+			Domain: domain,
+			Fields: fields,
+		})
+	}
+
+	if delete {
+		for _, domain := range remote {
+			if !ref[domain.Name] {
+				plan.Changes = append(plan.Changes, Change{
+					Action: actionDelete,
+					Domain: domain,
+				})
+			}
+		}
+	}
+
+	return plan
+}
+
+// diffDomain returns the field level changes required to turn domain a into
+// domain b.
+func diffDomain(a, b nimbusec.Domain) []FieldChange {
+	fields := []FieldChange{}
+	if a.Bundle != b.Bundle {
+		fields = append(fields, FieldChange{"bundle", a.Bundle, b.Bundle})
+	}
+	if a.Scheme != b.Scheme {
+		fields = append(fields, FieldChange{"scheme", a.Scheme, b.Scheme})
+	}
+	if a.DeepScan != b.DeepScan {
+		fields = append(fields, FieldChange{"deepScan", a.DeepScan, b.DeepScan})
+	}
+	if !equalStrings(a.FastScans, b.FastScans) {
+		fields = append(fields, FieldChange{"fastScans", a.FastScans, b.FastScans})
+	}
+	return fields
+}
+
+// equalStrings reports whether a and b hold the same strings in the same
+// order. A nil slice equals an empty one.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fingerprint computes a stable hash over the given domains. It is used to
+// detect whether the remote state changed between plan and apply.
+func fingerprint(domains []nimbusec.Domain) string {
+	sorted := make([]nimbusec.Domain, len(domains))
+	copy(sorted, domains)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Id < sorted[j].Id
+	})
+
+	hash := sha256.New()
+	json.NewEncoder(hash).Encode(sorted)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// writePlan stores the plan as indented JSON at the given path.
+func writePlan(path string, plan *Plan) error {
+	data, err := json.MarshalIndent(plan, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// readPlan loads a plan previously written by writePlan.
+func readPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := new(Plan)
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("invalid plan %s: %v", path, err)
+	}
+
+	return plan, nil
+}
+
+// printPlan writes a human readable summary of the plan to stdout.
+func printPlan(plan *Plan) {
+	for _, change := range plan.Changes {
+		fmt.Printf("%s domain: %s\n", change.Action, change.Domain.Name)
+		for _, field := range change.Fields {
+			fmt.Printf("\t%s: %v -> %v\n", field.Field, field.Before, field.After)
+		}
+	}
+
+	fmt.Printf("plan: %d to create, %d to update, %d to delete\n",
+		plan.Count(actionCreate), plan.Count(actionUpdate), plan.Count(actionDelete))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cumulodev/hoster-tools/internal/exitcode"
+)
+
+// results of a single domain job
+const (
+	resultCreated   = "created"
+	resultUpdated   = "updated"
+	resultUnchanged = "unchanged"
+	resultDeleted   = "deleted"
+	resultFailed    = "failed"
+)
+
+// Outcome records what happened to a single domain.
+type Outcome struct {
+	Domain string `json:"domain"`          // name of the domain
+	Action string `json:"action"`          // attempted action (create, update, upsert or delete)
+	Result string `json:"result"`          // created, updated, unchanged, deleted or failed
+	Error  string `json:"error,omitempty"` // reason if the action failed
+}
+
+// Report collects the outcomes of all jobs of a run. It is only modified from
+// the Save method of jobs, which the pool never calls concurrently.
+type Report struct {
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Interrupted bool      `json:"interrupted"` // whether the run was stopped early
+	Outcomes    []Outcome `json:"outcomes"`
+
+	journal *Journal // records every outcome if set
+}
+
+// NewReport creates an empty report for a run started now.
+func NewReport() *Report {
+	return &Report{
+		Started:  time.Now().UTC(),
+		Outcomes: []Outcome{},
+	}
+}
+
+// Add records the outcome of an action on the given domain. A non-nil err
+// marks the action as failed.
+func (r *Report) Add(domain, action, result string, err error) {
+	outcome := Outcome{
+		Domain: domain,
+		Action: action,
+		Result: result,
+	}
+	if err != nil {
+		outcome.Result = resultFailed
+		outcome.Error = err.Error()
+	}
+	r.Outcomes = append(r.Outcomes, outcome)
+
+	if err := r.journal.Record(action, domain, outcome.Result, err); err != nil {
+		log.Printf("failed to write journal: %v", err)
+	}
+}
+
+// Count returns the number of outcomes with the given result.
+func (r *Report) Count(result string) int {
+	n := 0
+	for _, outcome := range r.Outcomes {
+		if outcome.Result == result {
+			n++
+		}
+	}
+	return n
+}
+
+// ExitCode returns the exit code matching the outcomes of the run.
+func (r *Report) ExitCode() int {
+	if r.Interrupted {
+		return exitcode.Interrupted
+	}
+	if r.Count(resultFailed) > 0 {
+		return exitcode.Partial
+	}
+	return exitcode.OK
+}
+
+// Print writes a summary table of the run and the reason of every failed
+// domain to w.
+func (r *Report) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "RESULT\tDOMAINS\n")
+	for _, result := range []string{resultCreated, resultUpdated, resultUnchanged, resultDeleted, resultFailed} {
+		fmt.Fprintf(tw, "%s\t%d\n", result, r.Count(result))
+	}
+	tw.Flush()
+
+	if r.Interrupted {
+		fmt.Fprintln(w, "interrupted before all domains were synced")
+	}
+
+	if r.Count(resultFailed) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "FAILED\tACTION\tREASON\n")
+	for _, outcome := range r.Outcomes {
+		if outcome.Result == resultFailed {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", outcome.Domain, outcome.Action, outcome.Error)
+		}
+	}
+	tw.Flush()
+}
+
+// Write stores the report as indented JSON at the given path.
+func (r *Report) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// State remembers which import rows were synced successfully, so incremental
+// runs only have to send the rows that changed since.
+type State struct {
+	Updated time.Time        `json:"updated"` // end of the run that wrote the state
+	Source  string           `json:"source"`  // import file the rows were read from
+	Domains map[string]Entry `json:"domains"` // synced rows by domain name
+}
+
+// Entry is a single synced row.
+type Entry struct {
+	Hash string `json:"hash"` // hash of the row, see rowHash
+	Id   int    `json:"id"`   // ID of the remote domain
+}
+
+// NewState creates an empty state.
+func NewState() *State {
+	return &State{
+		Domains: make(map[string]Entry),
+	}
+}
+
+// rowHash computes a stable hash over the fields of an import row.
+func rowHash(domain nimbusec.Domain) string {
+	domain.Id = 0
+
+	hash := sha256.New()
+	json.NewEncoder(hash).Encode(domain)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Changed reports whether the row has to be sent because it was never synced
+// or changed since.
+func (s *State) Changed(name, hash string) bool {
+	entry, ok := s.Domains[name]
+	return !ok || entry.Hash != hash
+}
+
+// Resume records a row that the resumed run already upserted. The remote
+// domain was read after that run, so it reflects the result of the upsert.
+// Rows whose remote domain is missing are left out and sent again by the next
+// incremental run.
+func (s *State) Resume(row nimbusec.Domain, hash string, remote *nimbusec.Domain, update bool) {
+	switch {
+	case s == nil:
+	case remote == nil:
+		delete(s.Domains, row.Name)
+	case update || len(diffDomain(*remote, row)) == 0:
+		s.Domains[row.Name] = Entry{Hash: hash, Id: remote.Id}
+	default:
+		// without update, an existing domain keeps its remote values
+		s.Domains[row.Name] = Entry{Id: remote.Id}
+	}
+}
+
+// Retain forgets all rows not listed in names, i.e. rows that were removed
+// from the import.
+func (s *State) Retain(names map[string]bool) {
+	for name := range s.Domains {
+		if !names[name] {
+			delete(s.Domains, name)
+		}
+	}
+}
+
+// Mismatches compares the state with the remote domains and returns a
+// description of every difference. Synced domains must still exist with the
+// same ID and remote domains listed in the import must be known to the state.
+func (s *State) Mismatches(remote []nimbusec.Domain, desired map[string]bool) []string {
+	byId := make(map[int]nimbusec.Domain)
+	for _, domain := range remote {
+		byId[domain.Id] = domain
+	}
+
+	list := []string{}
+	for name, entry := range s.Domains {
+		domain, ok := byId[entry.Id]
+		switch {
+		case !ok:
+			list = append(list, fmt.Sprintf("%s (ID %d) no longer exists", name, entry.Id))
+		case domain.Name != name:
+			list = append(list, fmt.Sprintf("%s (ID %d) is named %s", name, entry.Id, domain.Name))
+		}
+	}
+
+	for _, domain := range remote {
+		if _, ok := s.Domains[domain.Name]; !ok && desired[domain.Name] {
+			list = append(list, fmt.Sprintf("%s (ID %d) is not in the state", domain.Name, domain.Id))
+		}
+	}
+
+	sort.Strings(list)
+	return list
+}
+
+// readState loads the state file. A missing file yields an empty state and
+// ok set to false.
+func readState(path string) (state *State, ok bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewState(), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	state = NewState()
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, false, fmt.Errorf("invalid state %s: %v", path, err)
+	}
+	if state.Domains == nil {
+		state.Domains = make(map[string]Entry)
+	}
+
+	return state, true, nil
+}
+
+// writeState stores the state at the given path. The file is replaced
+// atomically, so an interrupted run never leaves a truncated state behind.
+func writeState(path string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".sync-state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
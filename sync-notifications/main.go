@@ -0,0 +1,350 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cumulodev/goutils/pool"
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/exitcode"
+	"github.com/cumulodev/hoster-tools/internal/guard"
+	"github.com/cumulodev/nimbusec"
+)
+
+func main() {
+	url := flag.String("url", nimbusec.DefaultAPI, "API Url")
+	key := flag.String("key", "abc", "API key for authentication")
+	secret := flag.String("secret", "abc", "API secret for authentication")
+	file := flag.String("policy", "notifications.json", "path to the notification policy")
+	delete := flag.Bool("delete", false, "delete notifications of managed users that are not required by the policy")
+	allowEmpty := flag.Bool("allow-empty", false, "allow -delete to remove all notifications of managed users the policy has no rules for")
+	dryrun := flag.Bool("dry-run", false, "simulate what would be done without writing")
+	workers := flag.Int("workers", 1, "number of parallel workers (please do not use too many workers)")
+	guardFlags := guard.Flags(flag.CommandLine, "notifications")
+	configure := apiopts.Flags(flag.CommandLine)
+	flag.Parse()
+
+	limit, err := guardFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	policy, err := readPolicy(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// creates a new nimbusec API instance
+	api, err := apiopts.NewAPI(*url, *key, *secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configure(api)
+
+	domains, err := api.FindDomains(nimbusec.EmptyFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	users, err := api.FindUsers(nimbusec.EmptyFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pool := pool.New(*workers)
+	pool.Start()
+
+	// plan the changes of all users first, so the guards are checked before
+	// anything is written
+	failed := 0
+	covered := make(map[int]bool)
+	jobs := []*userJob{}
+	for _, user := range users {
+		job := &userJob{
+			api:     api,
+			policy:  policy,
+			user:    user,
+			domains: domains,
+			delete:  *delete,
+			failed:  &failed,
+			covered: covered,
+		}
+		jobs = append(jobs, job)
+		pool.Add(job)
+	}
+
+	pool.Wait()
+
+	if *delete {
+		total := 0
+		empty := []string{}
+		logins := []string{}
+		for _, job := range jobs {
+			total += job.existing
+			deletes := 0
+			for _, c := range job.changes {
+				if c.op == opDelete {
+					logins = append(logins, job.user.Login)
+					deletes++
+				}
+			}
+
+			// an empty or mistyped policy must not silently remove every
+			// notification of a user
+			if job.empty && deletes > 0 {
+				empty = append(empty, job.user.Login)
+			}
+		}
+
+		if len(empty) > 0 && !*allowEmpty {
+			log.Fatalf("the policy has no rules for users %s, all their notifications would be deleted; use -allow-empty if this is intended", strings.Join(empty, ", "))
+		}
+		if err := limit.Check(logins, total); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, job := range jobs {
+		if len(job.changes) > 0 {
+			pool.Add(&applyJob{
+				api:     api,
+				user:    job.user,
+				changes: job.changes,
+				dryrun:  *dryrun,
+				failed:  &failed,
+			})
+		}
+	}
+
+	pool.Wait()
+
+	// report domains nobody is notified about
+	missing := []string{}
+	for _, domain := range domains {
+		if !covered[domain.Id] {
+			missing = append(missing, domain.Name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		fmt.Printf("no notification: %s\n", name)
+	}
+	fmt.Printf("%d of %d domains without notification\n", len(missing), len(domains))
+
+	if failed > 0 {
+		fmt.Printf("%d users failed\n", failed)
+		os.Exit(exitcode.Partial)
+	}
+}
+
+// operations of a change
+const (
+	opCreate = "create"
+	opUpdate = "update"
+	opDelete = "delete"
+)
+
+// change is a single write needed to reconcile a user with the policy.
+type change struct {
+	op           string
+	notification nimbusec.Notification
+	domain       string // name of the notified domain
+}
+
+// userJob plans the changes that reconcile the notifications of a single
+// user with the policy.
+type userJob struct {
+	api     *nimbusec.API
+	policy  *Policy
+	user    nimbusec.User
+	domains []nimbusec.Domain
+	delete  bool
+	failed  *int
+	covered map[int]bool // domains with at least one notification, only written in Save
+
+	changes  []change
+	existing int   // number of notifications before the sync
+	empty    bool  // whether the policy has no rules for any of the user's domains
+	notified []int // domains of this user with notifications after the sync
+	messages []string
+	err      error
+}
+
+func (job *userJob) Work() {
+	existing, err := job.api.FindNotifications(job.user.Id, nimbusec.EmptyFilter)
+	if err != nil {
+		job.err = err
+		return
+	}
+	job.existing = len(existing)
+
+	// administrators see all domains and are only managed if the policy
+	// names them explicitly
+	_, named := job.policy.Users[job.user.Login]
+	if job.user.Role == nimbusec.RoleAdministrator && !named {
+		for _, n := range existing {
+			job.notified = append(job.notified, n.Domain)
+		}
+		return
+	}
+
+	visible := job.domains
+	if job.user.Role != nimbusec.RoleAdministrator {
+		set, err := job.api.GetDomainSet(&job.user)
+		if err != nil {
+			job.err = err
+			return
+		}
+
+		allowed := make(map[int]bool)
+		for _, id := range set {
+			allowed[id] = true
+		}
+
+		visible = []nimbusec.Domain{}
+		for _, domain := range job.domains {
+			if allowed[domain.Id] {
+				visible = append(visible, domain)
+			}
+		}
+	}
+
+	used := make(map[int]bool)
+	job.empty = len(visible) > 0
+	for _, domain := range visible {
+		rules := job.policy.rules(job.user, domain)
+		if len(rules) > 0 {
+			job.empty = false
+		}
+
+		for _, rule := range rules {
+			if rule.Transport == "sms" && job.user.Mobile == "" {
+				job.logf("skip sms notification: user %s has no mobile number (%s)", job.user.Login, domain.Name)
+				continue
+			}
+
+			notification := nimbusec.Notification{
+				Domain:     domain.Id,
+				Transport:  rule.Transport,
+				ServerSide: rule.ServerSide,
+				Content:    rule.Content,
+				Blacklist:  rule.Blacklist,
+			}
+
+			current := find(existing, domain.Id, rule.Transport)
+			switch {
+			case current == nil:
+				job.changes = append(job.changes, change{opCreate, notification, domain.Name})
+
+			case !rule.matches(*current):
+				used[current.Id] = true
+				notification.Id = current.Id
+				job.changes = append(job.changes, change{opUpdate, notification, domain.Name})
+
+			default:
+				used[current.Id] = true
+			}
+
+			job.notified = append(job.notified, domain.Id)
+		}
+	}
+
+	// notifications the policy does not require
+	for _, n := range existing {
+		if used[n.Id] {
+			continue
+		}
+
+		if !job.delete {
+			job.notified = append(job.notified, n.Domain)
+			continue
+		}
+
+		job.changes = append(job.changes, change{opDelete, n, job.name(n.Domain)})
+	}
+}
+
+// name returns the name of the domain with the given ID.
+func (job *userJob) name(id int) string {
+	for _, domain := range job.domains {
+		if domain.Id == id {
+			return domain.Name
+		}
+	}
+	return fmt.Sprintf("domain %d", id)
+}
+
+func (job *userJob) logf(format string, args ...interface{}) {
+	job.messages = append(job.messages, fmt.Sprintf(format, args...))
+}
+
+func (job *userJob) Save() {
+	for _, msg := range job.messages {
+		fmt.Println(msg)
+	}
+	for _, id := range job.notified {
+		job.covered[id] = true
+	}
+	if job.err != nil {
+		*job.failed++
+		fmt.Printf("error: user %s: %v\n", job.user.Login, job.err)
+	}
+}
+
+// applyJob writes the planned changes of a single user.
+type applyJob struct {
+	api     *nimbusec.API
+	user    nimbusec.User
+	changes []change
+	dryrun  bool
+	failed  *int
+
+	messages []string
+	err      error
+}
+
+func (job *applyJob) Work() {
+	for _, c := range job.changes {
+		n := c.notification
+		job.messages = append(job.messages, fmt.Sprintf("%s notification: %s %s for %s", c.op, job.user.Login, n.Transport, c.domain))
+		if job.dryrun {
+			continue
+		}
+
+		switch c.op {
+		case opCreate:
+			_, job.err = job.api.CreateNotification(job.user.Id, &n)
+		case opUpdate:
+			_, job.err = job.api.UpdateNotification(job.user.Id, &n)
+		case opDelete:
+			job.err = apiopts.Delete(func() error { return job.api.DeleteNotification(job.user.Id, &n) })
+		}
+		if job.err != nil {
+			return
+		}
+	}
+}
+
+func (job *applyJob) Save() {
+	for _, msg := range job.messages {
+		fmt.Println(msg)
+	}
+	if job.err != nil {
+		*job.failed++
+		fmt.Printf("error: user %s: %v\n", job.user.Login, job.err)
+	}
+}
+
+// find returns the notification of the domain over the given transport.
+func find(notifications []nimbusec.Notification, domain int, transport string) *nimbusec.Notification {
+	for i := range notifications {
+		if notifications[i].Domain == domain && notifications[i].Transport == transport {
+			return &notifications[i]
+		}
+	}
+	return nil
+}
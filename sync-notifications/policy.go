@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cumulodev/nimbusec"
+)
+
+// Rule is the desired notification over a single transport.
+type Rule struct {
+	Transport  string `json:"transport"`  // mail or sms
+	ServerSide int    `json:"serverside"` // minimum severity of serverside results
+	Content    int    `json:"content"`    // minimum severity of content results
+	Blacklist  int    `json:"blacklist"`  // minimum severity of blacklist results
+}
+
+// Policy declares which notifications users get for their domains. Rules
+// of a user take precedence over the rules of a domain's bundle, which take
+// precedence over the default rules.
+type Policy struct {
+	Default []Rule            `json:"default"` // rules for all domains
+	Bundles map[string][]Rule `json:"bundles"` // rules per bundle ID
+	Users   map[string][]Rule `json:"users"`   // rules per user login
+}
+
+// readPolicy loads and validates the policy file.
+func readPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := new(Policy)
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", path, err)
+	}
+
+	check := func(where string, rules []Rule) error {
+		seen := make(map[string]bool)
+		for _, rule := range rules {
+			if rule.Transport != "mail" && rule.Transport != "sms" {
+				return fmt.Errorf("invalid policy %s: %s: unknown transport %q, expected mail or sms", path, where, rule.Transport)
+			}
+			if seen[rule.Transport] {
+				return fmt.Errorf("invalid policy %s: %s: transport %s defined twice", path, where, rule.Transport)
+			}
+			seen[rule.Transport] = true
+
+			for _, severity := range []int{rule.ServerSide, rule.Content, rule.Blacklist} {
+				if severity < 0 {
+					return fmt.Errorf("invalid policy %s: %s: negative severity", path, where)
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := check("default", policy.Default); err != nil {
+		return nil, err
+	}
+	for bundle, rules := range policy.Bundles {
+		if err := check("bundle "+bundle, rules); err != nil {
+			return nil, err
+		}
+	}
+	for login, rules := range policy.Users {
+		if err := check("user "+login, rules); err != nil {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+// rules returns the rules that apply to the domain for the given user.
+func (p *Policy) rules(user nimbusec.User, domain nimbusec.Domain) []Rule {
+	if rules, ok := p.Users[user.Login]; ok {
+		return rules
+	}
+	if rules, ok := p.Bundles[domain.Bundle]; ok {
+		return rules
+	}
+	return p.Default
+}
+
+// matches reports whether the notification satisfies the rule.
+func (r Rule) matches(n nimbusec.Notification) bool {
+	return n.Transport == r.Transport &&
+		n.ServerSide == r.ServerSide &&
+		n.Content == r.Content &&
+		n.Blacklist == r.Blacklist
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/cumulodev/goutils/pool"
+	"github.com/cumulodev/hoster-tools/internal/apiopts"
+	"github.com/cumulodev/hoster-tools/internal/exitcode"
+	"github.com/cumulodev/hoster-tools/internal/guard"
+	"github.com/cumulodev/nimbusec"
+)
+
+func main() {
+	url := flag.String("url", nimbusec.DefaultAPI, "API Url")
+	key := flag.String("key", "abc", "API key for authentication")
+	secret := flag.String("secret", "abc", "API secret for authentication")
+	file := flag.String("file", "users.csv", "path to customer import file")
+	delete := flag.Bool("delete", false, "delete users from nimbusec if not provided in the CSV (administrators are never deleted)")
+	update := flag.Bool("update", false, "updates user info and domain sets; false to just insert new users")
+	dryrun := flag.Bool("dry-run", false, "simulate what would be done without writing")
+	workers := flag.Int("workers", 1, "number of parallel workers (please do not use too many workers)")
+	guardFlags := guard.Flags(flag.CommandLine, "users")
+	configure := apiopts.Flags(flag.CommandLine)
+	flag.Parse()
+
+	limit, err := guardFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// creates a new nimbusec API instance
+	api, err := apiopts.NewAPI(*url, *key, *secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configure(api)
+
+	// domains are required to resolve the domain names of the customers
+	domains, err := api.FindDomains(nimbusec.EmptyFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	customers, err := readCustomers(*file, domains)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	users, err := api.FindUsers(nimbusec.EmptyFilter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	existing := make(map[string]nimbusec.User)
+	for _, user := range users {
+		existing[user.Login] = user
+	}
+
+	// users not listed in the customer file
+	obsolete := []nimbusec.User{}
+	if *delete {
+		ref := make(map[string]bool)
+		for _, c := range customers {
+			ref[c.user.Login] = true
+		}
+
+		logins := []string{}
+		for _, user := range users {
+			if ref[user.Login] || user.Role == nimbusec.RoleAdministrator {
+				continue
+			}
+			obsolete = append(obsolete, user)
+			logins = append(logins, user.Login)
+		}
+
+		// check the guards before anything is written
+		if err := limit.Check(logins, len(users)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	pool := pool.New(*workers)
+	pool.Start()
+
+	failed := 0
+	for _, c := range customers {
+		job := &userJob{
+			api:      api,
+			customer: c,
+			update:   *update,
+			dryrun:   *dryrun,
+			failed:   &failed,
+		}
+		if user, ok := existing[c.user.Login]; ok {
+			job.existing = &user
+		}
+		pool.Add(job)
+	}
+
+	pool.Wait()
+
+	// delete users not listed in the customer file
+	for _, user := range obsolete {
+		pool.Add(&deleteJob{
+			api:    api,
+			user:   user,
+			dryrun: *dryrun,
+			failed: &failed,
+		})
+	}
+	pool.Wait()
+
+	if failed > 0 {
+		fmt.Printf("%d users failed\n", failed)
+		os.Exit(exitcode.Partial)
+	}
+}
+
+// userJob creates or updates a single user and its domain set.
+type userJob struct {
+	api      *nimbusec.API
+	customer customer
+	existing *nimbusec.User // remote user, nil if new
+	update   bool
+	dryrun   bool
+	failed   *int
+
+	messages []string
+	err      error
+}
+
+func (job *userJob) Work() {
+	user := job.customer.user
+	isNew := job.existing == nil
+
+	switch {
+	case isNew:
+		job.logf("create user: %s", describe(user))
+		if !job.dryrun {
+			created, err := job.api.CreateUser(&user)
+			if err != nil {
+				job.err = err
+				return
+			}
+			user.Id = created.Id
+		}
+
+	case job.update:
+		user.Id = job.existing.Id
+		// passwords are only set when creating users, never overwrite the
+		// password a customer chose
+		user.Password = ""
+
+		if fields := changedFields(*job.existing, user); len(fields) > 0 {
+			job.logf("update user: %s (%s)", describe(user), strings.Join(fields, ", "))
+			if !job.dryrun {
+				if _, err := job.api.UpdateUser(&user); err != nil {
+					job.err = err
+					return
+				}
+			}
+		}
+
+	default:
+		// existing users are left alone without update
+		return
+	}
+
+	// administrators can access all domains anyway
+	if user.Role != nimbusec.RoleUser {
+		return
+	}
+
+	current := []int{}
+	if !isNew {
+		set, err := job.api.GetDomainSet(&user)
+		if err != nil {
+			job.err = err
+			return
+		}
+		current = set
+	}
+
+	if sameSet(current, job.customer.domains) {
+		return
+	}
+
+	job.logf("update domains of user: %s (%d -> %d domains)", user.Login, len(current), len(job.customer.domains))
+	if !job.dryrun && user.Id != 0 {
+		if _, err := job.api.UpdateDomainSet(&user, job.customer.domains); err != nil {
+			job.err = err
+		}
+	}
+}
+
+func (job *userJob) logf(format string, args ...interface{}) {
+	job.messages = append(job.messages, fmt.Sprintf(format, args...))
+}
+
+func (job *userJob) Save() {
+	for _, msg := range job.messages {
+		fmt.Println(msg)
+	}
+	if job.err != nil {
+		*job.failed++
+		fmt.Printf("error: user %s (line %d): %v\n", job.customer.user.Login, job.customer.line, job.err)
+	}
+}
+
+// deleteJob deletes a user that is not listed in the customer file.
+type deleteJob struct {
+	api    *nimbusec.API
+	user   nimbusec.User
+	dryrun bool
+	failed *int
+
+	err error
+}
+
+func (job *deleteJob) Work() {
+	if !job.dryrun {
+		job.err = apiopts.Delete(func() error { return job.api.DeleteUser(&job.user) })
+	}
+}
+
+func (job *deleteJob) Save() {
+	fmt.Printf("delete user: %s\n", describe(job.user))
+	if job.err != nil {
+		*job.failed++
+		fmt.Printf("error: user %s: %v\n", job.user.Login, job.err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cumulodev/hoster-tools/internal/importcsv"
+	"github.com/cumulodev/nimbusec"
+)
+
+// schema of the customer import file; all trailing fields list the domains
+// of the customer
+var schema = importcsv.Schema{
+	Columns:  []string{"login", "mail", "role", "forename", "surname", "company", "title", "mobile", "password"},
+	Repeated: "domain",
+	Aliases: map[string]string{
+		"email":     "mail",
+		"firstname": "forename",
+		"lastname":  "surname",
+		"phone":     "mobile",
+		"domains":   "domain",
+	},
+}
+
+// customer is a validated record of the customer import file.
+type customer struct {
+	line    int
+	user    nimbusec.User
+	domains []int // IDs of the domains owned by the customer
+}
+
+// readCustomers reads and validates the customer import file. Domain names
+// are resolved to the IDs of the given domains.
+func readCustomers(path string, domains []nimbusec.Domain) ([]customer, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	rows, err := importcsv.Read(fh, schema)
+	problems, ok := err.(importcsv.Errors)
+	if err != nil && !ok {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	ids := make(map[string]int)
+	for _, domain := range domains {
+		ids[strings.ToLower(domain.Name)] = domain.Id
+	}
+
+	customers := []customer{}
+	lines := make(map[string]int)
+	for _, row := range rows {
+		c := customer{
+			line: row.Line,
+			user: nimbusec.User{
+				Login:    row.Get("login"),
+				Mail:     row.Get("mail"),
+				Role:     strings.ToLower(row.Get("role")),
+				Forename: row.Get("forename"),
+				Surname:  row.Get("surname"),
+				Company:  row.Get("company"),
+				Title:    row.Get("title"),
+				Mobile:   row.Get("mobile"),
+				Password: row.Get("password"),
+			},
+			domains: []int{},
+		}
+
+		switch {
+		case c.user.Login == "":
+			problems.Add(row.Line, "missing login")
+		case lines[c.user.Login] > 0:
+			problems.Add(row.Line, "duplicate login %q, already defined in line %d", c.user.Login, lines[c.user.Login])
+		default:
+			lines[c.user.Login] = row.Line
+		}
+
+		if !strings.Contains(c.user.Mail, "@") {
+			problems.Add(row.Line, "invalid mail address %q", c.user.Mail)
+		}
+
+		switch c.user.Role {
+		case "":
+			c.user.Role = nimbusec.RoleUser
+		case nimbusec.RoleUser, nimbusec.RoleAdministrator:
+		default:
+			problems.Add(row.Line, "invalid role %q, expected %s or %s", c.user.Role, nimbusec.RoleUser, nimbusec.RoleAdministrator)
+		}
+
+		// a domain field may list several domains separated by ; or spaces
+		for _, field := range row.Values("domain") {
+			names := strings.FieldsFunc(field, func(r rune) bool {
+				return r == ';' || r == ' '
+			})
+			for _, name := range names {
+				id, ok := ids[strings.ToLower(name)]
+				if !ok {
+					problems.Add(row.Line, "unknown domain %q", name)
+					continue
+				}
+				c.domains = append(c.domains, id)
+			}
+		}
+
+		customers = append(customers, c)
+	}
+
+	if err := problems.Err(); err != nil {
+		return nil, err
+	}
+	return customers, nil
+}
+
+// describe formats the user for output. Passwords and signature keys are
+// never printed.
+func describe(user nimbusec.User) string {
+	return fmt.Sprintf("%s <%s> (%s)", user.Login, user.Mail, user.Role)
+}
+
+// changedFields lists the profile fields that differ between the remote user
+// and the user of the import file.
+func changedFields(remote, user nimbusec.User) []string {
+	fields := []string{}
+	if remote.Mail != user.Mail {
+		fields = append(fields, "mail")
+	}
+	if remote.Role != user.Role {
+		fields = append(fields, "role")
+	}
+	if remote.Forename != user.Forename {
+		fields = append(fields, "forename")
+	}
+	if remote.Surname != user.Surname {
+		fields = append(fields, "surname")
+	}
+	if remote.Company != user.Company {
+		fields = append(fields, "company")
+	}
+	if remote.Title != user.Title {
+		fields = append(fields, "title")
+	}
+	if remote.Mobile != user.Mobile {
+		fields = append(fields, "mobile")
+	}
+	return fields
+}
+
+// sameSet reports whether a and b contain the same domain IDs.
+func sameSet(a, b []int) bool {
+	set := make(map[int]bool)
+	for _, id := range a {
+		set[id] = true
+	}
+
+	other := make(map[int]bool)
+	for _, id := range b {
+		if !set[id] {
+			return false
+		}
+		other[id] = true
+	}
+	return len(set) == len(other)
+}